@@ -48,12 +48,24 @@ func Initialize() {
 	config = LoadConfig()
 	logger = MakeLogger(config.LogDir, "gocd-golang-agent.log", config.OutputDebugLog)
 	LogInfo(">>>>>>> go >>>>>>>")
+	for _, warning := range configWarnings {
+		LogInfo("WARN: %v", warning)
+	}
+	// looked up by connecting to Go server, which logs with a proxy
+	config.IpAddress = lookupIpAddress(config.ServerHostAndPort, config.ProxyUrl)
 	LogInfo("working directory: %v", config.WorkingDir)
 	if _, err := os.Stat(config.WorkingDir); err != nil {
 		logger.Error.Fatal(err)
 	}
 
-	if err := Mkdirs(config.ConfigDir); err != nil {
+	if err := os.MkdirAll(config.ConfigDir, 0700); err != nil {
+		logger.Error.Fatal(err)
+	}
+	// config directory made by old agents is readable by other users
+	if err := os.Chmod(config.ConfigDir, 0700); err != nil {
+		logger.Error.Fatal(err)
+	}
+	if err := CheckKeyPermissions(); err != nil {
 		logger.Error.Fatal(err)
 	}
 
@@ -67,15 +79,26 @@ func Initialize() {
 	}
 	if AgentId == "" {
 		AgentId = uuid.NewV4().String()
-		ioutil.WriteFile(config.AgentIdFile, []byte(AgentId), 0644)
+		if err := WriteFileAtomic(config.AgentIdFile, []byte(AgentId), 0600); err != nil {
+			logger.Error.Fatalf("failed to write uuid file(%v): %v", config.AgentIdFile, err)
+		}
+	}
+	if _, err := envProfile.load(config.EnvProfileFile); err != nil {
+		logger.Error.Printf("failed to load env profile: %v", err)
 	}
 }
 
 func Start() error {
+	if CheckAgentCert() {
+		if err := renewRegistration("agent certificate is expired or invalid"); err != nil {
+			return err
+		}
+	}
 	err := Register()
 	if err != nil {
 		return err
 	}
+	CheckAgentCert()
 
 	httpClient, err := GoServerRemoteClient(true)
 	if err != nil {
@@ -83,6 +106,9 @@ func Start() error {
 	}
 
 	conn, err := MakeWebsocketConnection(config.WssServerURL(), config.HttpsServerURL())
+	if isAgentCertRejected(err) {
+		renewRegistration(Sprintf("agent certificate is rejected: %v", err))
+	}
 	if err != nil {
 		return err
 	}
@@ -90,11 +116,19 @@ func Start() error {
 	defer closeBuildSession()
 
 	pingTick := time.NewTicker(10 * time.Second)
+	defer pingTick.Stop()
+	certTick := time.NewTicker(AgentCertCheckInterval)
+	defer certTick.Stop()
 	ping(conn.Send)
 	for {
 		select {
 		case <-pingTick.C:
 			ping(conn.Send)
+		case <-certTick.C:
+			if CheckAgentCert() {
+				renewRegistration("agent certificate is expired")
+				return Err("agent certificate is expired")
+			}
 		case msg, ok := <-conn.Received:
 			if !ok {
 				return Err("Websocket connection is closed")
@@ -118,16 +152,22 @@ func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *p
 		return Err("received reregister message")
 	case protocol.BuildAction:
 		closeBuildSession()
-		build := msg.DataBuild()
+		build, err := msg.DataBuild()
+		if err != nil {
+			rejectBuild(send, build, err)
+			return nil
+		}
 		SetState("buildLocator", build.BuildLocator)
 		SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
 		curl, err := config.MakeFullServerURL(build.ConsoleUrl)
 		if err != nil {
-			return err
+			rejectBuild(send, build, err)
+			return nil
 		}
 		aurl, err := config.MakeFullServerURL(build.ArtifactUploadBaseUrl)
 		if err != nil {
-			return err
+			rejectBuild(send, build, err)
+			return nil
 		}
 		buildSession = MakeBuildSession(
 			build.BuildId,
@@ -141,13 +181,34 @@ func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *p
 		buildSession.ReplaceEcho("${agent.location}", config.WorkingDir)
 		buildSession.ReplaceEcho("${agent.hostname}", config.Hostname)
 		buildSession.ReplaceEcho("${date}", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
+		buildSession.SetTimeout(buildTimeout(build))
+		if err := envProfile.Apply(buildSession, config.EnvProfileFile); err != nil {
+			LogInfo("failed to load env profile: %v", err)
+			buildSession.warn("Failed to load env profile, use the one loaded before: %v", err)
+		}
+		if config.ExportCIEnv {
+			buildSession.SetEnv("CI", "true")
+			buildSession.SetEnv("TERM", config.ConsoleTerm)
+		}
 		go processBuild(send, buildSession)
 	default:
-		panic(Sprintf("Unknown message action: %+v", msg))
+		LogInfo("WARN: ignore message with unknown action: %v", msg.Action)
 	}
 	return nil
 }
 
+// rejectBuild reports the build failed to Go server, when the build
+// message is malformed and the build can't run.
+func rejectBuild(send chan *protocol.Message, build *protocol.Build, err error) {
+	logger.Error.Printf("reject malformed build[%v]: %v", build.BuildId, err)
+	send <- protocol.CompletedMessage(&protocol.Report{
+		AgentRuntimeInfo: GetAgentRuntimeInfo(),
+		BuildId:          build.BuildId,
+		Result:           protocol.BuildFailed,
+		Reason:           Sprintf("Malformed build: %v", err),
+	})
+}
+
 func processBuild(send chan *protocol.Message, buildSession *BuildSession) {
 	defer func() {
 		SetState("runtimeStatus", "Idle")
@@ -160,6 +221,16 @@ func processBuild(send chan *protocol.Message, buildSession *BuildSession) {
 	LogInfo("done")
 }
 
+// buildTimeout is the shorter one of the build timeout and the agent's,
+// when they are both set.
+func buildTimeout(build *protocol.Build) time.Duration {
+	timeout := time.Duration(build.Timeout) * time.Second
+	if timeout <= 0 || config.BuildTimeout > 0 && config.BuildTimeout < timeout {
+		timeout = config.BuildTimeout
+	}
+	return timeout
+}
+
 func ping(send chan *protocol.Message) {
 	send <- protocol.PingMessage(GetAgentRuntimeInfo())
 }
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var AgentCertCheckInterval = 1 * time.Hour
+
+// AgentCertExpiry returns when the agent certificate expires.
+func AgentCertExpiry() (time.Time, error) {
+	data, err := ioutil.ReadFile(config.AgentCertFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, Err("no certificate found in %v", config.AgentCertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// CheckAgentCert logs a warning when the agent certificate expires in
+// config.CertExpiryWarning, and sets state "agentCertificate" for it.
+// It returns true when the certificate has expired, or can't be read, so
+// that the agent should register again.
+func CheckAgentCert() bool {
+	if isTokenRegistration() {
+		SetState("agentCertificate", "not used, registered by token")
+		return false
+	}
+	if _, err := os.Stat(config.AgentCertFile); os.IsNotExist(err) {
+		SetState("agentCertificate", "not registered")
+		return false
+	}
+	expiry, err := AgentCertExpiry()
+	if err != nil {
+		logger.Error.Printf("invalid agent certificate: %v", err)
+		SetState("agentCertificate", Sprintf("invalid: %v", err))
+		return true
+	}
+	left := expiry.Sub(time.Now())
+	switch {
+	case left <= 0:
+		logger.Error.Printf("agent certificate expired at %v", expiry)
+		SetState("agentCertificate", Sprintf("expired at %v", expiry))
+		return true
+	case left <= config.CertExpiryWarning:
+		LogInfo("WARN: agent certificate expires in %v at %v", left, expiry)
+		SetState("agentCertificate", Sprintf("expires at %v", expiry))
+	default:
+		SetState("agentCertificate", Sprintf("valid until %v", expiry))
+	}
+	return false
+}
+
+// isAgentCertRejected tells whether err is Go server rejecting the agent
+// certificate in tls handshake.
+func isAgentCertRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, alert := range []string{"bad certificate", "expired certificate",
+		"revoked certificate", "unknown certificate", "certificate required"} {
+		if strings.Contains(msg, "remote error: tls: "+alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// renewRegistration removes the agent key, certificate and token, so that
+// the agent registers again with Go server on next start. Go server CA is
+// kept, a tls alert from the network must not undo the trust in it.
+func renewRegistration(reason string) error {
+	LogInfo("renew agent registration: %v", reason)
+	return cleanAgentCredentials()
+}
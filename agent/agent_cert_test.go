@@ -0,0 +1,95 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func generateCert(t *testing.T, certFile, keyFile string, validFrom time.Time, validFor time.Duration) {
+	cert := server.NewCert("localhost")
+	cert.ValidFrom = validFrom
+	cert.ValidFor = validFor
+	err := cert.Generate(certFile, keyFile)
+	assert.Nil(t, err)
+}
+
+func TestCheckAgentCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-cert")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	config := GetConfig()
+	oldCertFile := config.AgentCertFile
+	defer func() {
+		config.AgentCertFile = oldCertFile
+	}()
+	config.AgentCertFile = filepath.Join(dir, "agent-cert.pem")
+	keyFile := filepath.Join(dir, "agent-private-key.pem")
+	now := time.Now()
+
+	assert.Equal(t, false, CheckAgentCert())
+	assert.Equal(t, "not registered", GetState("agentCertificate"))
+
+	generateCert(t, config.AgentCertFile, keyFile, now, 365*24*time.Hour)
+	assert.Equal(t, false, CheckAgentCert())
+	assert.True(t, startWith(GetState("agentCertificate"), "valid until"), GetState("agentCertificate"))
+
+	generateCert(t, config.AgentCertFile, keyFile, now, 24*time.Hour)
+	assert.Equal(t, false, CheckAgentCert())
+	assert.True(t, startWith(GetState("agentCertificate"), "expires at"), GetState("agentCertificate"))
+
+	generateCert(t, config.AgentCertFile, keyFile, now.Add(-2*time.Hour), time.Hour)
+	assert.Equal(t, true, CheckAgentCert())
+	assert.True(t, startWith(GetState("agentCertificate"), "expired at"), GetState("agentCertificate"))
+
+	err = ioutil.WriteFile(config.AgentCertFile, []byte("not a certificate"), 0600)
+	assert.Nil(t, err)
+	assert.Equal(t, true, CheckAgentCert())
+}
+
+func TestShouldRegisterAgainWhenAgentCertExpired(t *testing.T) {
+	config := GetConfig()
+	err := Mkdirs(config.ConfigDir)
+	assert.Nil(t, err)
+	generateCert(t, config.AgentCertFile, config.AgentPrivateKeyFile, time.Now().Add(-2*time.Hour), time.Hour)
+	assert.Nil(t, ReadGoServerCACert())
+	ca, err := os.Stat(config.GoServerCAFile)
+	assert.Nil(t, err)
+
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	expiry, err := AgentCertExpiry()
+	assert.Nil(t, err)
+	assert.True(t, expiry.After(time.Now()), expiry)
+	// pinned Go server CA is not fetched again
+	caAfter, err := os.Stat(config.GoServerCAFile)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(ca, caAfter))
+}
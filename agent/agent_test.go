@@ -57,6 +57,7 @@ func TestSetCookieAfterConnected(t *testing.T) {
 }
 
 func TestMain(m *testing.M) {
+	ExecBuildProcess()
 	flag.Parse()
 
 	workingDir, err := ioutil.TempDir("", "gocd-golang-agent")
@@ -82,6 +83,7 @@ func TestMain(m *testing.M) {
 	os.Setenv("GOCD_SERVER_URL", goServerUrl)
 	os.Setenv("GOCD_SERVER_WEB_SOCKET_PATH", server.WebSocketPath)
 	os.Setenv("GOCD_SERVER_REGISTRATION_PATH", server.RegistrationPath)
+	os.Setenv("GOCD_SERVER_TOKEN_PATH", server.TokenPath)
 	os.Setenv("GOCD_AGENT_WORKING_DIR", agentWorkingDir)
 	os.Setenv("GOCD_AGENT_LOG_DIR", agentWorkingDir)
 
@@ -168,10 +170,14 @@ func (log *StateLog) notify(state string) {
 }
 
 func (log *StateLog) Next() string {
+	return log.NextIn(1 * time.Second)
+}
+
+func (log *StateLog) NextIn(timeout time.Duration) string {
 	select {
 	case state := <-log.states:
 		return state
-	case <-time.After(1 * time.Second):
+	case <-time.After(timeout):
 		return "timeout"
 	}
 }
@@ -321,3 +327,69 @@ func tearDown() {
 		println("WARN: clean up pipeline directory failed:", err.Error())
 	}
 }
+
+func TestBuildWithTokenRegistration(t *testing.T) {
+	config := GetConfig()
+	config.RegistrationMode = RegistrationModeToken
+	defer func() {
+		config.RegistrationMode = RegistrationModeCert
+	}()
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+	_, err = os.Stat(config.AgentCertFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPingShouldAdvertiseVersionAndCapabilities(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	info := goServer.AgentRuntimeInfo(AgentId)
+	assert.NotNil(t, info)
+	assert.Equal(t, Version, info.AgentVersion)
+	assert.Equal(t, protocol.ProtocolVersion, info.ProtocolVersion)
+	capabilities := strings.Join(info.Capabilities, ",")
+	assert.True(t, contains(capabilities, "command:exec,"), capabilities)
+	assert.True(t, contains(capabilities, "command:parallel,"), capabilities)
+	assert.True(t, contains(capabilities, "feature:expandEnv,"), capabilities)
+	assert.Equal(t, Capabilities(), info.Capabilities)
+}
+
+func TestShouldIgnoreMessageWithUnknownAction(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.Send(AgentId, &protocol.Message{Action: "fancy"})
+	goServer.SendRaw(AgentId, []byte("not gzipped json"))
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+}
+
+func TestReportMalformedBuildAsFailed(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.Send(AgentId, &protocol.Message{
+		Action: protocol.BuildAction,
+		Data:   Sprintf(`{"BuildId":"%v","BuildCommand":"echo"}`, buildId),
+	})
+	assert.Equal(t, "build Failed", stateLog.Next())
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
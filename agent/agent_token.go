@@ -0,0 +1,110 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// RegistrationModeCert registers the agent for a key and certificate
+	// issued by Go server, which the agent presents in tls handshake.
+	RegistrationModeCert = "cert"
+	// RegistrationModeToken registers the agent with a token issued by
+	// Go server, which the agent sends with its GUID in request headers.
+	RegistrationModeToken = "token"
+
+	AgentGUIDHeader = "X-Agent-GUID"
+)
+
+func isTokenRegistration() bool {
+	return config.RegistrationMode == RegistrationModeToken
+}
+
+// readAgentToken fetches the agent token from Go server, when it is not
+// saved in config.AgentTokenFile yet.
+func readAgentToken() (string, error) {
+	if data, err := ioutil.ReadFile(config.AgentTokenFile); err == nil {
+		return string(data), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	client, err := GoServerRemoteClient(false)
+	if err != nil {
+		return "", err
+	}
+	u, err := config.TokenURL()
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = url.Values{"uuid": {AgentId}}.Encode()
+	LogInfo("fetching agent token from: %v", u)
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", Err("Fetch agent token failed: %v %v", resp.Status, readBody(resp))
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", Err("Go server issued an empty agent token")
+	}
+	if err := WriteFileAtomic(config.AgentTokenFile, []byte(token), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func agentTokenHeader() (http.Header, error) {
+	token, err := readAgentToken()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set(AgentGUIDHeader, AgentId)
+	header.Set("Authorization", token)
+	return header, nil
+}
+
+// tokenTransport adds the agent GUID and token to every request.
+type tokenTransport struct {
+	transport http.RoundTripper
+	header    http.Header
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	r.Header = make(http.Header)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for k, v := range t.header {
+		r.Header[k] = v
+	}
+	return t.transport.RoundTrip(&r)
+}
@@ -54,7 +54,10 @@ func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
 			close(console.closed)
 			LogInfo("build console closed")
 		}()
-		tw := stream.NewPrefixWriter(console.buffer, timestampPrefix)
+		// whole lines get timestamps and are sent in one piece; no flush
+		// timeout, the buffer is only touched in this goroutine, partial
+		// lines are flushed with the buffer instead
+		tw := stream.NewLineWriter(stream.NewPrefixWriter(console.buffer, timestampPrefix), 0)
 		flushTick := time.NewTicker(5 * time.Second)
 		defer flushTick.Stop()
 		for {
@@ -62,9 +65,11 @@ func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
 			case log := <-console.write:
 				tw.Write(log)
 			case <-console.stop:
+				tw.Flush()
 				console.Flush()
 				return
 			case <-flushTick.C:
+				tw.Flush()
 				console.Flush()
 			}
 		}
@@ -95,9 +100,11 @@ func (console *BuildConsole) Flush() {
 		ContentLength: int64(console.buffer.Len()),
 		Close:         true,
 	}
-	_, err := console.HttpClient.Do(&req)
+	resp, err := console.HttpClient.Do(&req)
 	if err != nil {
 		logger.Error.Printf("build console flush failed: %v", err)
+	} else {
+		resp.Body.Close()
 	}
 	console.buffer.Reset()
 }
@@ -0,0 +1,46 @@
+// +build !linux
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+type limitsWatch struct{}
+
+func ExecBuildProcess() {
+}
+
+func limitBuildCommand(s *BuildSession, execCmd *exec.Cmd) (*limitsWatch, error) {
+	if config.BuildLimits != nil && *config.BuildLimits != (BuildLimits{}) {
+		return nil, Err("build limits are not supported on %v", runtime.GOOS)
+	}
+	return &limitsWatch{}, nil
+}
+
+func (w *limitsWatch) release() {
+}
+
+func (w *limitsWatch) explain(err error) error {
+	return err
+}
+
+func removeBuildCgroup(buildId string) {
+}
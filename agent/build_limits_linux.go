@@ -0,0 +1,236 @@
+// +build linux
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// missing from package syscall
+const rlimitNproc = 0x6
+
+type limitsWatch struct {
+	limits *BuildLimits
+	cgroup string
+	// cgroup directory the process is created in
+	cgroupDir *os.File
+	// cgroup event counters before the process started
+	events map[string]uint64
+}
+
+// rlimitsEnv tells a started build process the resource limits to set
+// on itself before it executes the build command at rlimitsPathEnv, see
+// ExecBuildProcess.
+const (
+	rlimitsEnv     = "GOCD_AGENT_EXEC_RLIMITS"
+	rlimitsPathEnv = "GOCD_AGENT_EXEC_PATH"
+)
+
+// ExecBuildProcess executes the build command when the process is a build
+// process the agent started to set build limits, and returns otherwise.
+// It must be called first in main, before the command line is parsed.
+func ExecBuildProcess() {
+	if spec, ok := os.LookupEnv(rlimitsEnv); ok {
+		execWithRlimits(spec, os.Getenv(rlimitsPathEnv))
+	}
+}
+
+// execWithRlimits sets the resource limits in spec and executes the build
+// command path in place of the agent binary it was started as.
+func execWithRlimits(spec, path string) {
+	for _, r := range strings.Split(spec, ",") {
+		var resource int
+		var limit syscall.Rlimit
+		if _, err := fmt.Sscanf(r, "%d:%d:%d", &resource, &limit.Cur, &limit.Max); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid resource limit %v: %v\n", r, err)
+			os.Exit(126)
+		}
+		if err := syscall.Setrlimit(resource, &limit); err != nil {
+			fmt.Fprintf(os.Stderr, "set resource limit %v failed: %v\n", r, err)
+			os.Exit(126)
+		}
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, rlimitsEnv+"=") && !strings.HasPrefix(kv, rlimitsPathEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	err := syscall.Exec(path, os.Args, env)
+	fmt.Fprintf(os.Stderr, "exec %v failed: %v\n", path, err)
+	os.Exit(127)
+}
+
+// limitBuildCommand makes the process of execCmd start under the
+// configured build limits. It is created in the build cgroup, and it sets
+// its resource limits before executing the build command, so nothing the
+// build command does is left out of them. The returned watch must be
+// released once the process is started.
+func limitBuildCommand(s *BuildSession, execCmd *exec.Cmd) (*limitsWatch, error) {
+	w := &limitsWatch{limits: config.BuildLimits}
+	if w.limits == nil {
+		return w, nil
+	}
+	rlimits := []struct {
+		resource int
+		max      uint64
+	}{
+		{syscall.RLIMIT_AS, w.limits.AddressSpace},
+		{syscall.RLIMIT_NOFILE, w.limits.OpenFiles},
+		{rlimitNproc, w.limits.Processes},
+		// SIGXCPU at the soft limit tells why the process was terminated
+		{syscall.RLIMIT_CPU, w.limits.CPUTime},
+	}
+	var spec []string
+	for _, r := range rlimits {
+		if r.max == 0 {
+			continue
+		}
+		max := r.max
+		if r.resource == syscall.RLIMIT_CPU {
+			max++
+		}
+		spec = append(spec, Sprintf("%v:%v:%v", r.resource, r.max, max))
+	}
+	if len(spec) > 0 && execCmd.Err == nil {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		execCmd.Env = append(execCmd.Env, rlimitsEnv+"="+strings.Join(spec, ","), rlimitsPathEnv+"="+execCmd.Path)
+		execCmd.Path = self
+	}
+
+	if w.limits.CgroupDir != "" {
+		cgroup, err := buildCgroup(s.buildId)
+		if err != nil {
+			return nil, err
+		}
+		w.cgroup = cgroup
+		w.events = readCgroupEvents(cgroup)
+		w.cgroupDir, err = os.Open(cgroup)
+		if err != nil {
+			return nil, err
+		}
+		if execCmd.SysProcAttr == nil {
+			execCmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		execCmd.SysProcAttr.UseCgroupFD = true
+		execCmd.SysProcAttr.CgroupFD = int(w.cgroupDir.Fd())
+	}
+	return w, nil
+}
+
+// release closes what the process needed to be started.
+func (w *limitsWatch) release() {
+	if w.cgroupDir != nil {
+		w.cgroupDir.Close()
+	}
+}
+
+// explain tells which limit the process exceeded when it failed.
+func (w *limitsWatch) explain(err error) error {
+	if err == nil || w.limits == nil {
+		return err
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && w.limits.CPUTime > 0 {
+		status, _ := exitErr.Sys().(syscall.WaitStatus)
+		used := exitErr.UserTime() + exitErr.SystemTime()
+		limit := time.Duration(w.limits.CPUTime) * time.Second
+		if status.Signaled() && (status.Signal() == syscall.SIGXCPU || used >= limit) {
+			return Err("exceeded CPU time limit of %v: %v", limit, err)
+		}
+	}
+	if w.cgroup != "" {
+		events := readCgroupEvents(w.cgroup)
+		if events["memory.oom_kill"] > w.events["memory.oom_kill"] {
+			return Err("exceeded memory limit of %v bytes: %v", w.limits.Memory, err)
+		}
+		if events["pids.max"] > w.events["pids.max"] {
+			return Err("exceeded process count limit of %v: %v", w.limits.Processes, err)
+		}
+	}
+	return err
+}
+
+func buildCgroupPath(buildId string) string {
+	return filepath.Join(config.BuildLimits.CgroupDir, "gocd-build-"+buildId)
+}
+
+func buildCgroup(buildId string) (string, error) {
+	cgroup := buildCgroupPath(buildId)
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		if os.IsExist(err) {
+			return cgroup, nil
+		}
+		return "", err
+	}
+	controls := map[string]uint64{
+		"memory.max": config.BuildLimits.Memory,
+		"pids.max":   config.BuildLimits.Processes,
+	}
+	for file, max := range controls {
+		if max == 0 {
+			continue
+		}
+		err := ioutil.WriteFile(filepath.Join(cgroup, file), []byte(strconv.FormatUint(max, 10)), 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+	return cgroup, nil
+}
+
+func removeBuildCgroup(buildId string) {
+	if config.BuildLimits == nil || config.BuildLimits.CgroupDir == "" {
+		return
+	}
+	cgroup := buildCgroupPath(buildId)
+	if err := os.Remove(cgroup); err != nil && !os.IsNotExist(err) {
+		logger.Error.Printf("failed to remove build cgroup %v: %v", cgroup, err)
+	}
+}
+
+func readCgroupEvents(cgroup string) map[string]uint64 {
+	events := make(map[string]uint64)
+	for _, controller := range []string{"memory", "pids"} {
+		data, err := ioutil.ReadFile(filepath.Join(cgroup, controller+".events"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				events[controller+"."+fields[0]] = n
+			}
+		}
+	}
+	return events
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func withBuildLimits(t *testing.T, limits *BuildLimits) func() {
+	if runtime.GOOS != "linux" {
+		t.Skip("build limits are only supported on linux")
+	}
+	config := GetConfig()
+	original := config.BuildLimits
+	config.BuildLimits = limits
+	return func() {
+		config.BuildLimits = original
+	}
+}
+
+func TestBuildLimitsOpenFiles(t *testing.T) {
+	defer withBuildLimits(t, &BuildLimits{OpenFiles: 64})()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("bash", "-c", "ulimit -n; echo ${GOCD_AGENT_EXEC_RLIMITS-unset}"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "64\nunset\n", trimTimestamp(log))
+}
+
+func TestBuildLimitsShouldReportCPUTimeLimitExceeded(t *testing.T) {
+	defer withBuildLimits(t, &BuildLimits{CPUTime: 1})()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("bash", "-c", "while :; do :; done"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	log := stateLog.Next()
+	for log == "timeout" {
+		log = stateLog.Next()
+	}
+	assert.Equal(t, "build Failed", log)
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, startWith(trimTimestamp(log), "ERROR: exceeded CPU time limit of 1s: "), log)
+}
+
+func TestInvalidBuildLimitShouldFallBackToNoLimit(t *testing.T) {
+	os.Setenv("GOCD_AGENT_BUILD_LIMIT_OPEN_FILES", "lots")
+	defer os.Unsetenv("GOCD_AGENT_BUILD_LIMIT_OPEN_FILES")
+	os.Setenv("GOCD_AGENT_BUILD_LIMIT_CPU_TIME", "10")
+	defer os.Unsetenv("GOCD_AGENT_BUILD_LIMIT_CPU_TIME")
+
+	config := LoadConfig()
+	assert.Equal(t, uint64(0), config.BuildLimits.OpenFiles)
+	assert.Equal(t, uint64(10), config.BuildLimits.CPUTime)
+}
@@ -24,7 +24,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,14 +37,58 @@ const (
 )
 
 var (
-	CancelCommandTimeout   = DefaultCancelCommandTimeout
-	CancelBuildTimeout     = 30 * time.Second
-	BuildDebugToConsoleLog = true
+	CancelCommandTimeout    = DefaultCancelCommandTimeout
+	CancelBuildTimeout      = 30 * time.Second
+	ConsoleLineFlushTimeout = 1 * time.Second
+	BuildDebugToConsoleLog  = true
 )
 
 type Executor func(session *BuildSession, cmd *protocol.BuildCommand) error
 
+var (
+	registeredExecutors   = make(map[string]Executor)
+	registeredExecutorsMu sync.Mutex
+)
+
+// RegisterExecutor adds a build command to the build sessions made after
+// it. It panics if the name is taken by another build command.
+func RegisterExecutor(name string, executor Executor) {
+	registeredExecutorsMu.Lock()
+	defer registeredExecutorsMu.Unlock()
+	if executor == nil {
+		panic("RegisterExecutor: executor is nil for " + name)
+	}
+	if _, ok := builtinExecutors()[name]; ok {
+		panic("RegisterExecutor: build command " + name + " is builtin")
+	}
+	if _, ok := registeredExecutors[name]; ok {
+		panic("RegisterExecutor: build command " + name + " is registered twice")
+	}
+	registeredExecutors[name] = executor
+}
+
+// Executors returns the builtin build commands, the registered ones and
+// the plugins found in config.PluginsDir. A builtin command takes
+// precedence over a registered one, which takes precedence over a plugin.
 func Executors() map[string]Executor {
+	executors := make(map[string]Executor)
+	if config != nil && config.PluginsDir != "" {
+		for name, executor := range PluginExecutors(config.PluginsDir) {
+			executors[name] = executor
+		}
+	}
+	registeredExecutorsMu.Lock()
+	defer registeredExecutorsMu.Unlock()
+	for name, executor := range registeredExecutors {
+		executors[name] = executor
+	}
+	for name, executor := range builtinExecutors() {
+		executors[name] = executor
+	}
+	return executors
+}
+
+func builtinExecutors() map[string]Executor {
 	return map[string]Executor{
 		protocol.CommandExport:              CommandExport,
 		protocol.CommandEcho:                CommandEcho,
@@ -49,6 +96,8 @@ func Executors() map[string]Executor {
 		protocol.CommandReportCurrentStatus: CommandReport,
 		protocol.CommandReportCompleting:    CommandReport,
 		protocol.CommandCompose:             CommandCompose,
+		protocol.CommandParallel:            CommandParallel,
+		protocol.CommandRetry:               CommandRetry,
 		protocol.CommandCond:                CommandCond,
 		protocol.CommandAnd:                 CommandAnd,
 		protocol.CommandOr:                  CommandOr,
@@ -72,15 +121,25 @@ type BuildSession struct {
 	command               *protocol.BuildCommand
 	artifactUploadBaseURL *url.URL
 
-	envs    map[string]string
-	cancel  chan bool
-	done    chan bool
-	echo    *stream.SubstituteWriter
-	secrets *stream.SubstituteWriter
+	// a nil value unsets the variable inherited from the agent
+	envs map[string]*string
+	// names of envs exported as secure, their values are masked in
+	// console log once expanded
+	secureEnvs map[string]bool
+	cancel     chan bool
+	cancelOnce sync.Once
+	done       chan bool
+	echo       *stream.SubstituteWriter
+	secrets    *stream.SubstituteWriter
+	// stderr of build processes goes to secrets when stderr is nil
+	stderr *stream.SubstituteWriter
 
 	buildId     string
 	buildStatus string
 
+	timeout  time.Duration
+	timedOut chan bool
+
 	rootDir string
 	wd      string
 
@@ -104,18 +163,39 @@ func MakeBuildSession(buildId string,
 		artifactUploadBaseURL: artifactUploadBaseURL,
 		command:               command,
 		send:                  send,
-		envs:                  make(map[string]string),
+		envs:                  make(map[string]*string),
+		secureEnvs:            make(map[string]bool),
 		cancel:                make(chan bool),
 		done:                  make(chan bool),
 		secrets:               secrets,
 		echo:                  stream.NewSubstituteWriter(secrets),
 		rootDir:               rootDir,
 		executors:             Executors(),
+		timedOut:              make(chan bool),
 	}
 }
 
+// Close cancels the build, and waits for it to finish.
 func (s *BuildSession) Close() error {
-	return closeAndWait(s.cancel, s.done, CancelBuildTimeout)
+	s.stop()
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(CancelBuildTimeout):
+		return Err("Wait for closed timeout")
+	}
+}
+
+func (s *BuildSession) stop() {
+	s.cancelOnce.Do(func() {
+		close(s.cancel)
+	})
+}
+
+// SetTimeout makes the build cancel itself when it runs longer than
+// timeout, zero means no timeout.
+func (s *BuildSession) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
 }
 
 func (s *BuildSession) isCanceled() bool {
@@ -132,14 +212,60 @@ func (s *BuildSession) isCanceled() bool {
 
 func (s *BuildSession) Run() error {
 	defer func() {
+		removeBuildCgroup(s.buildId)
+		if isClosedChan(s.timedOut) {
+			s.ConsoleLog("ERROR: Build timed out after %v and is canceled.\n", s.timeout)
+		}
 		s.console.Close()
 		s.send <- protocol.CompletedMessage(s.Report(""))
 		LogInfo("Build completed")
 	}()
 	LogInfo("Build started, root directory: %v", s.rootDir)
+	if unsupported := s.unsupportedCommands(); len(unsupported) > 0 {
+		close(s.done)
+		s.buildStatus = protocol.BuildFailed
+		err := Err("Build commands not supported by this agent: %v", strings.Join(unsupported, ", "))
+		s.ConsoleLog("ERROR: %v\n", err)
+		return err
+	}
+	if s.timeout > 0 {
+		timer := time.AfterFunc(s.timeout, func() {
+			LogInfo("Build timed out after %v, cancel it", s.timeout)
+			close(s.timedOut)
+			s.stop()
+		})
+		defer timer.Stop()
+	}
 	return s.ProcessCommand()
 }
 
+// unsupportedCommands returns names of the build commands in the build
+// having no executor, so that the build fails before running any of them.
+func (s *BuildSession) unsupportedCommands() []string {
+	found := make(map[string]bool)
+	var walk func(cmd *protocol.BuildCommand)
+	walk = func(cmd *protocol.BuildCommand) {
+		if cmd == nil {
+			return
+		}
+		if s.executors[cmd.Name] == nil {
+			found[cmd.Name] = true
+		}
+		for _, sub := range cmd.SubCommands {
+			walk(sub)
+		}
+		walk(cmd.Test)
+		walk(cmd.OnCancel)
+	}
+	walk(s.command)
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (s *BuildSession) ProcessCommand() error {
 	defer func() {
 		close(s.done)
@@ -172,19 +298,22 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 		s.buildStatus = protocol.BuildCanceled
 	} else if err != nil && s.buildStatus != protocol.BuildFailed {
 		s.buildStatus = protocol.BuildFailed
-		errMsg := Sprintf("ERROR: %v\n", err)
-		LogInfo(errMsg)
-		s.ConsoleLog(errMsg)
+		LogInfo("ERROR: %v", err)
+		s.ConsoleLog("ERROR: %v\n", err)
 	}
 
 	return
 }
 
 func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
-	s.wd = filepath.Clean(filepath.Join(s.rootDir, cmd.WorkingDirectory))
+	wd := cmd.WorkingDirectory
+	if s.expandEnv(cmd) {
+		wd = s.ExpandEnv(wd)
+	}
+	s.wd = filepath.Clean(filepath.Join(s.rootDir, wd))
 	s.debugLog("set wd to %v", s.wd)
 
-	if !strings.HasPrefix(s.wd, s.rootDir) {
+	if !isInDir(s.wd, s.rootDir) {
 		return Err("Working directory[%v] is outside the agent sandbox.", s.wd)
 	}
 	_, err := os.Stat(s.wd)
@@ -204,6 +333,24 @@ func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
 	}
 }
 
+// sandboxPath is path in the working directory, it must not escape the
+// agent sandbox, e.g. by "..", or reach the agent configuration and keys,
+// or the plugins, which are in the agent working directory too.
+func (s *BuildSession) sandboxPath(path string) (string, error) {
+	p := filepath.Clean(filepath.Join(s.wd, path))
+	if !isInDir(p, s.rootDir) {
+		return "", Err("%v is outside the agent sandbox.", p)
+	}
+	if config != nil && (isInDir(p, config.ConfigDir) || isInDir(p, config.PluginsDir)) {
+		return "", Err("%v is in the agent configuration or plugins directory.", p)
+	}
+	return p, nil
+}
+
+func isInDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
 func (s *BuildSession) testFailed(test *protocol.BuildCommand) bool {
 	if test == nil {
 		return false
@@ -234,6 +381,7 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
 		send:        s.send,
 		envs:        s.envs,
+		secureEnvs:  s.secureEnvs,
 		secrets:     s.secrets,
 		echo:        s.echo,
 		rootDir:     s.rootDir,
@@ -255,14 +403,16 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 }
 
 func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buffer, error) {
-	var output bytes.Buffer
+	var output, errOutput bytes.Buffer
 	session := &BuildSession{
 		buildId:               s.buildId,
 		artifacts:             s.artifacts,
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
 		send:        s.send,
 		envs:        s.envs,
+		secureEnvs:  s.secureEnvs,
 		secrets:     s.secrets.Filter(&output),
+		stderr:      s.secrets.Filter(&errOutput),
 		echo:        s.echo.Filter(&output),
 		rootDir:     s.rootDir,
 		executors:   s.executors,
@@ -274,6 +424,9 @@ func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buf
 	}
 
 	err := session.ProcessCommand()
+	if errOutput.Len() > 0 {
+		s.debugLog("test command stderr: %v", errOutput.String())
+	}
 	return output, err
 }
 
@@ -283,7 +436,15 @@ func (s *BuildSession) Report(jobState string) *protocol.Report {
 		BuildId:          s.buildId,
 		JobState:         jobState,
 		Result:           s.buildStatus,
+		Reason:           s.reason(),
+	}
+}
+
+func (s *BuildSession) reason() string {
+	if isClosedChan(s.timedOut) {
+		return Sprintf("Build timed out after %v", s.timeout)
 	}
+	return ""
 }
 
 func (s *BuildSession) ConsoleLog(format string, a ...interface{}) {
@@ -294,16 +455,133 @@ func (s *BuildSession) ReplaceEcho(name string, value interface{}) {
 	s.echo.Substitutions[name] = value
 }
 
+func (s *BuildSession) SetEnv(name, value string) {
+	s.envs[name] = &value
+}
+
+func (s *BuildSession) UnsetEnv(name string) {
+	s.envs[name] = nil
+}
+
+// Env returns the environment of build processes: the agent's environment
+// overridden by the variables set in the build, sorted by name.
 func (s *BuildSession) Env() []string {
-	osEnv := os.Environ()
-	bsEnv := make([]string, 0, len(s.envs)+len(osEnv))
-	bsEnv = append(bsEnv, osEnv...)
-	for key, value := range s.envs {
-		bsEnv = append(bsEnv, Sprintf("%v=%v", key, value))
+	env := make(map[string]string)
+	names := make(map[string]string)
+	set := func(name, value string) {
+		key := envKey(name)
+		if old, ok := names[key]; ok && old != name {
+			delete(env, old)
+		}
+		names[key] = name
+		env[name] = value
 	}
+	for _, kv := range os.Environ() {
+		// on windows, there are variables like "=C:=C:\" for the
+		// current directory of each drive
+		if i := strings.Index(kv, "="); i > 0 {
+			set(kv[:i], kv[i+1:])
+		} else if i == 0 {
+			if i = strings.Index(kv[1:], "="); i >= 0 {
+				set(kv[:i+1], kv[i+2:])
+			}
+		}
+	}
+	for name, value := range s.envs {
+		if value != nil {
+			set(name, *value)
+		} else if old, ok := names[envKey(name)]; ok {
+			delete(env, old)
+		}
+	}
+
+	bsEnv := make([]string, 0, len(env))
+	for name, value := range env {
+		bsEnv = append(bsEnv, Sprintf("%v=%v", name, value))
+	}
+	sort.Strings(bsEnv)
 	return bsEnv
 }
 
+// envKey is the key of an environment variable name, which is case
+// insensitive on windows.
+func envKey(name string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(name)
+	}
+	return name
+}
+
+// ExpandEnv replaces ${NAME} in str with the value of environment variable
+// NAME in the build, or empty when it is not set. "$${" escapes "${".
+func (s *BuildSession) ExpandEnv(str string) string {
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(str, "${")
+		if i < 0 {
+			break
+		}
+		if i > 0 && str[i-1] == '$' {
+			buf.WriteString(str[:i])
+			buf.WriteString("{")
+			str = str[i+2:]
+			continue
+		}
+		end := strings.Index(str[i:], "}")
+		if end < 0 {
+			break
+		}
+		buf.WriteString(str[:i])
+		name := str[i+2 : i+end]
+		value := s.lookupEnv(name)
+		if s.secureEnvs[name] && value != "" {
+			// the expanded value may show up in console log
+			s.secrets.Substitutions[value] = DefaultSecretMask
+		}
+		buf.WriteString(value)
+		str = str[i+end+1:]
+	}
+	buf.WriteString(str)
+	return buf.String()
+}
+
+func (s *BuildSession) lookupEnv(name string) string {
+	if value, ok := s.envs[name]; ok {
+		if value == nil {
+			return ""
+		}
+		return *value
+	}
+	return os.Getenv(name)
+}
+
+// hasEnv tells whether the variable is set by the build, or set to
+// something by the agent's environment.
+func (s *BuildSession) hasEnv(name string) bool {
+	if value, ok := s.envs[name]; ok {
+		return value != nil
+	}
+	return os.Getenv(name) != ""
+}
+
+// expandEnv tells whether ${NAME} in args of cmd should be expanded: the
+// "expandEnv" arg of cmd, or config.ExpandEnv without it.
+func (s *BuildSession) expandEnv(cmd *protocol.BuildCommand) bool {
+	if arg, ok := cmd.Args["expandEnv"]; ok {
+		return arg == "true"
+	}
+	return config.ExpandEnv
+}
+
+// arg returns arg name of cmd, with environment variables expanded when
+// expandEnv is on for cmd.
+func (s *BuildSession) arg(cmd *protocol.BuildCommand, name string) string {
+	if s.expandEnv(cmd) {
+		return s.ExpandEnv(cmd.Args[name])
+	}
+	return cmd.Args[name]
+}
+
 func (s *BuildSession) warn(format string, a ...interface{}) {
 	s.ConsoleLog(Sprintf("WARN: %v\n", format), a...)
 }
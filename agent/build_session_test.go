@@ -19,6 +19,7 @@ import (
 	"github.com/bmatcuk/doublestar"
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
 	"github.com/xli/assert"
 	"io"
 	"io/ioutil"
@@ -92,6 +93,185 @@ exec command should have this
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestExportModes(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	os.Setenv("TEST_EXPORT_UNSET", "agent value")
+	defer os.Setenv("TEST_EXPORT_UNSET", "")
+	export := func(name, mode, value string) *protocol.BuildCommand {
+		return protocol.ExportCommand(name, value, "false").AddArg("mode", mode)
+	}
+	sep := string(os.PathListSeparator)
+
+	goServer.SendBuild(AgentId, buildId,
+		export("TEST_EXPORT_UNSET", ExportUnset, ""),
+		protocol.ExecCommand("bash", "-c", "echo ${TEST_EXPORT_UNSET-unset}"),
+		export("TEST_EXPORT_PATH", ExportAppend, "b"),
+		export("TEST_EXPORT_PATH", ExportAppend, "c"),
+		export("TEST_EXPORT_PATH", ExportPrepend, "a"),
+		protocol.ExecCommand("bash", "-c", "echo $TEST_EXPORT_PATH"),
+		export("TEST_EXPORT_PATH", ExportUnset, ""),
+		export("TEST_EXPORT_PATH", ExportPrepend, "d"),
+		protocol.ExecCommand("bash", "-c", "echo $TEST_EXPORT_PATH"),
+		export("TEST_EXPORT_PATH", "replace", "e"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `unsetting environment variable 'TEST_EXPORT_UNSET'
+unset
+appending environment variable 'TEST_EXPORT_PATH' with value 'b'
+appending environment variable 'TEST_EXPORT_PATH' with value 'c'
+prepending environment variable 'TEST_EXPORT_PATH' with value 'a'
+a` + sep + `b` + sep + `c
+unsetting environment variable 'TEST_EXPORT_PATH'
+prepending environment variable 'TEST_EXPORT_PATH' with value 'd'
+d
+ERROR: Unknown export mode: replace
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestEnvShouldNotHaveDuplicatedNames(t *testing.T) {
+	os.Setenv("TEST_ENV_DUP", "agent")
+	defer os.Setenv("TEST_ENV_DUP", "")
+	os.Setenv("TEST_ENV_UNSET", "agent")
+	defer os.Setenv("TEST_ENV_UNSET", "")
+	s := MakeBuildSession("id", nil, nil, nil, nil, nil, "")
+	s.SetEnv("TEST_ENV_DUP", "build")
+	s.UnsetEnv("TEST_ENV_UNSET")
+
+	var dup []string
+	names := make(map[string]bool)
+	for _, kv := range s.Env() {
+		name := split(kv, "=")[0]
+		if names[name] {
+			dup = append(dup, name)
+		}
+		names[name] = true
+		if name == "TEST_ENV_DUP" {
+			assert.Equal(t, "TEST_ENV_DUP=build", kv)
+		}
+	}
+	assert.Equal(t, 0, len(dup), dup)
+	assert.True(t, names["TEST_ENV_DUP"])
+	assert.True(t, !names["TEST_ENV_UNSET"])
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("TEST_EXPAND_OS", "os")
+	defer os.Setenv("TEST_EXPAND_OS", "")
+	s := MakeBuildSession("id", nil, nil, nil, nil, nil, "")
+	s.SetEnv("TEST_EXPAND_OS", "build")
+	s.SetEnv("FOO", "foo")
+
+	var tests = []struct {
+		str      string
+		expected string
+	}{
+		{"", ""},
+		{"foo", "foo"},
+		{"${FOO}", "foo"},
+		{"a${FOO}b${FOO}", "afoobfoo"},
+		{"${TEST_EXPAND_OS}", "build"},
+		{"${TEST_EXPAND_NOT_SET}.", "."},
+		{"$FOO", "$FOO"},
+		{"$${FOO}", "${FOO}"},
+		{"$$${FOO}", "$${FOO}"},
+		{"${FOO", "${FOO"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, s.ExpandEnv(test.str))
+	}
+}
+
+func TestExpandEnvInCommandArgs(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	err := os.MkdirAll(filepath.Join(wd, "dir-foo"), 0755)
+	assert.Nil(t, err)
+	expand := func(cmd *protocol.BuildCommand) *protocol.BuildCommand {
+		return cmd.AddArg("expandEnv", "true")
+	}
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("NAME", "foo", "false"),
+		protocol.ExportCommand("TOKEN", "thisissecret", "true"),
+		expand(protocol.ExportCommand("GREETING", "hello ${NAME}", "false")),
+		expand(protocol.ExportCommand("AUTH", "token ${TOKEN}", "false")),
+		expand(protocol.ExecCommand("echo", "${GREETING}", "$${NAME}", "${AUTH}")),
+		protocol.ExecCommand("echo", "${NAME}"),
+		expand(protocol.ExecCommand("pwd")).Setwd(relativePath(filepath.Join(wd, "dir-${NAME}"))),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`setting environment variable 'NAME' to value 'foo'
+setting environment variable 'TOKEN' to value '********'
+setting environment variable 'GREETING' to value 'hello foo'
+setting environment variable 'AUTH' to value 'token ********'
+hello foo ${NAME} token ********
+${NAME}
+%v
+`, filepath.Join(wd, "dir-foo"))
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestExportWithoutValueShouldMaskSecureValue(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("MY_TOKEN", "supersecretvalue", "true"),
+		protocol.ExportCommand("MY_TOKEN"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'MY_TOKEN' to value '********'
+setting environment variable 'MY_TOKEN' to value '********'
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestSecureExportShouldBeMaskedWhenExpanded(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	expand := func(cmd *protocol.BuildCommand) *protocol.BuildCommand {
+		return cmd.AddArg("expandEnv", "true")
+	}
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("TOKEN", "thisissecret", "true"),
+		protocol.ExecCommand("echo", "thisissecret"),
+		expand(protocol.ExecCommand("echo", "${TOKEN}")),
+		protocol.ExecCommand("echo", "thisissecret"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'TOKEN' to value '********'
+thisissecret
+********
+********
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
 func TestExecCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -106,6 +286,281 @@ func TestExecCommand(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "abcd\n", trimTimestamp(log))
 }
+
+func TestExecCommandShouldFlushIncompleteAnsiEscapeSequence(t *testing.T) {
+	config := GetConfig()
+	config.ConsoleAnsi = stream.AnsiStrip
+	defer func() {
+		config.ConsoleAnsi = stream.AnsiKeep
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("printf", "done \x1b]0;no terminator"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "done ]0;no terminator"), log)
+}
+
+func TestUnknownConsoleAnsiModeShouldFallBackToKeep(t *testing.T) {
+	os.Setenv("GOCD_AGENT_CONSOLE_ANSI", "colorful")
+	defer os.Unsetenv("GOCD_AGENT_CONSOLE_ANSI")
+
+	assert.Equal(t, stream.AnsiKeep, LoadConfig().ConsoleAnsi)
+	os.Setenv("GOCD_AGENT_CONSOLE_ANSI", stream.AnsiNormalize)
+	assert.Equal(t, stream.AnsiNormalize, LoadConfig().ConsoleAnsi)
+}
+
+func TestExecCommandShouldStripAnsiEscapeSequences(t *testing.T) {
+	config := GetConfig()
+	config.ConsoleAnsi = stream.AnsiStrip
+	defer func() {
+		config.ConsoleAnsi = stream.AnsiKeep
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("printf", "\x1b[31mred\x1b[0m\n"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "red\n", trimTimestamp(log))
+}
+
+func TestExportCIEnv(t *testing.T) {
+	config := GetConfig()
+	config.ExportCIEnv = true
+	defer func() {
+		config.ExportCIEnv = false
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("bash", "-c", "echo $CI $TERM"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("true %v\n", config.ConsoleTerm), trimTimestamp(log))
+}
+
+func TestExecCommandShouldTagStderrLines(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("bash", "-c", "echo out; echo err1 >&2; echo err2 >&2").AddArg("stderrPrefix", "[stderr] "),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(strings.TrimSpace(trimTimestamp(log)), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"[stderr] err1", "[stderr] err2", "out"}, lines)
+}
+
+func TestExecCommandShouldSaveOutputStreamsToFiles(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$$$$"),
+		protocol.ExecCommand("bash", "-c", "echo out thisissecret; echo err >&2").
+			AddArg("stdoutFile", "logs/stdout.txt").
+			AddArg("stderrFile", "logs/stderr.txt").
+			Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	stdout, err := ioutil.ReadFile(filepath.Join(wd, "logs/stdout.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "out $$$$$$\n", string(stdout))
+	stderr, err := ioutil.ReadFile(filepath.Join(wd, "logs/stderr.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "err\n", string(stderr))
+}
+
+func TestExecCommandShouldNotSaveOutputStreamsOutsideSandbox(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("echo", "hello").
+			AddArg("stdoutFile", "../../../escaped.txt").
+			Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "is outside the agent sandbox."), log)
+	_, err = os.Stat(filepath.Join(os.Getenv("GOCD_AGENT_WORKING_DIR"), "..", "escaped.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("echo", "hello").
+			AddArg("stderrFile", "../../config/agent-private-key.pem").
+			Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err = goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "is in the agent configuration or plugins directory."), log)
+}
+
+func TestTestCommandEqShouldIgnoreStderr(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	testCmd := protocol.TestCommand("-eq", "hello", "bash", "-c", "echo hello; echo warning >&2")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.EchoCommand("equal").SetTest(testCmd),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "equal\n", trimTimestamp(log))
+}
+
+func TestExecCommandStdin(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	err := writeFile(wd, "input.txt", "from file\n")
+	assert.Nil(t, err)
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("cat").AddArg("stdin", "inline\n"),
+		protocol.ExecCommand("cat").AddArg("stdinFile", "input.txt").Setwd(relativePath(wd)),
+		protocol.ExecCommand("cat"),
+		protocol.ExecCommand("bash", "-c", "read line; echo read: $line"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "inline\nfrom file\nread:\n", trimTimestamp(log))
+}
+
+func TestExecCommandShouldFailWhenStdinFileDoesNotExist(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("cat").AddArg("stdinFile", "notexist.txt"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestExecCommandShouldNotReadStdinFileOutsideSandbox(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("cat").AddArg("stdinFile", "../../../../etc/hostname").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "is outside the agent sandbox."), log)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("cat").AddArg("stdinFile", "../../config/agent-private-key.pem").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err = goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "is in the agent configuration or plugins directory."), log)
+	assert.True(t, !strings.Contains(log, "PRIVATE KEY"), log)
+}
+
+func TestExecCommandWithTty(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("exec with tty is only supported on linux")
+	}
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$$$$"),
+		protocol.ExecCommand("bash", "-c", "test -t 0 && test -t 1 && echo tty thisissecret; echo err >&2").AddArg("tty", "true"),
+		protocol.ExecCommand("bash", "-c", "test -t 1 || echo no tty"),
+		protocol.ExecCommand("bash", "-c", "exit 3").AddArg("tty", "true"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "tty $$$$$$\nerr\nno tty\nERROR: exit status 3\n", trimTimestamp(log))
+}
+
+func TestCancelExecCommandWithTty(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("exec with tty is only supported on linux")
+	}
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").AddArg("tty", "true"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
 func TestMkdirCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -206,6 +661,25 @@ func TestShouldMaskSecretInExecOutput(t *testing.T) {
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestShouldMaskSecretSplitAcrossExecOutputChunks(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$$$$"),
+		protocol.ExecCommand("bash", "-c", "printf 'hello (thisis'; sleep 0.1; echo 'secret)'"),
+		protocol.ExecCommand("bash", "-c", "printf 'no newline'"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("hello ($$$$$$)\nno newline\n")
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
 func TestReplaceAgentBuildVairables(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -245,8 +719,11 @@ func TestFailBuildWhenThereIsUnsupportedBuildCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	cmd := protocol.NewBuildCommand("fancy")
-	goServer.SendBuild(AgentId, buildId, cmd)
+	goServer.SendBuild(AgentId, buildId,
+		echo("should not process this echo"),
+		protocol.NewBuildCommand("fancy"),
+		echo("hello").SetOnCancel(protocol.NewBuildCommand("fancier")),
+	)
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Failed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -254,7 +731,7 @@ func TestFailBuildWhenThereIsUnsupportedBuildCommand(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	expected := Sprintf("ERROR: Unknown build command: fancy\n")
+	expected := Sprintf("ERROR: Build commands not supported by this agent: fancier, fancy\n")
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
@@ -522,6 +999,86 @@ func TestOrCommand(t *testing.T) {
 		{or(falsy, falsy, falsy), "ERROR: \n", "Failed"}})
 }
 
+func TestParallelCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	parallel := func(cmds ...*protocol.BuildCommand) *protocol.BuildCommand {
+		return protocol.ParallelCommand(cmds...).AddArg("maxConcurrency", "1")
+	}
+
+	verify(t, []TestRow{
+		{parallel(), "", "Passed"},
+		{parallel(echo("foo"), echo("bar")), "[1] foo\n[2] bar\n", "Passed"},
+		{parallel(echo("foo"), echo("bar")).AddListArg("prefixes", []string{"a| ", "b| "}),
+			"a| foo\nb| bar\n", "Passed"},
+		{parallel(protocol.FailCommand("foo"), echo("bar")),
+			"[1] ERROR: foo\n[2] bar\nERROR: 1 of 2 parallel commands failed\n", "Failed"},
+		{parallel(protocol.ComposeCommand(
+			protocol.FailCommand("foo"),
+			echo("failed").RunIf("failed")),
+			echo("passed").RunIf("failed")),
+			"[1] ERROR: foo\n[1] failed\nERROR: 1 of 2 parallel commands failed\n", "Failed"},
+		{protocol.ComposeCommand(
+			protocol.FailCommand("foo"),
+			parallel(echo("foo"), echo("bar")).RunIf("failed")),
+			"ERROR: foo\n[1] foo\n[2] bar\n", "Failed"},
+		{parallel(protocol.SecretCommand("foo", "***"), echo("foo")), "[2] foo\n", "Passed"},
+		{protocol.ParallelCommand().AddArg("maxConcurrency", "0"), "ERROR: Invalid maxConcurrency: 0\n", "Failed"},
+	})
+}
+
+func TestParallelCommandShouldRunSubCommandsConcurrently(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	// each sub command waits for the file the other one creates
+	wait := func(name string) string {
+		return Sprintf("for i in $(seq 50); do [ -f %v ] && break; sleep 0.1; done", name)
+	}
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$"),
+		protocol.ParallelCommand(
+			protocol.ExecCommand("bash", "-c", "touch a; "+wait("b")+"; echo thisissecret"),
+			protocol.ExecCommand("bash", "-c", "touch b; "+wait("a")),
+		),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "[1] $$$\n", trimTimestamp(log))
+}
+
+func TestRetryCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	retry := protocol.RetryCommand
+	// fails until it runs the given times
+	flaky := func(name string, times int) *protocol.BuildCommand {
+		return protocol.ExecCommand("bash", "-c",
+			Sprintf("echo x >> %v; [ $(wc -l < %v) -ge %v ]", name, name, times))
+	}
+
+	verify(t, []TestRow{
+		{retry("3", echo("foo")), "Attempt 1 of 3\nfoo\n", "Passed"},
+		{retry("3", flaky("a", 2)),
+			"Attempt 1 of 3\nERROR: exit status 1\nWARN: Retry in 0s.\nAttempt 2 of 3\n", "Passed"},
+		{retry("2", protocol.FailCommand("foo")),
+			"Attempt 1 of 2\nERROR: foo\nWARN: Retry in 0s.\nAttempt 2 of 2\nERROR: foo\n", "Failed"},
+		{retry("3", protocol.FailCommand("foo")).AddArg("delay", "10ms").AddArg("backoff", "2"),
+			"Attempt 1 of 3\nERROR: foo\nWARN: Retry in 10ms.\n" +
+				"Attempt 2 of 3\nERROR: foo\nWARN: Retry in 20ms.\n" +
+				"Attempt 3 of 3\nERROR: foo\n", "Failed"},
+		{protocol.ComposeCommand(
+			protocol.FailCommand("foo"),
+			retry("2", flaky("b", 2)).RunIf("any"),
+		), "ERROR: foo\nAttempt 1 of 2\n", "Failed"},
+		{retry("0", echo("foo")), "ERROR: Invalid attempts: 0\n", "Failed"},
+		{retry("1", echo("foo")).AddArg("delay", "soon"), "ERROR: Invalid delay: soon\n", "Failed"},
+	})
+}
+
 type TestRow struct {
 	command  *protocol.BuildCommand
 	expected string
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"sort"
+)
+
+// Version of the agent advertised to Go server, set by main.
+var Version = "0.0"
+
+// features are optional features of the agent Go server may rely on when
+// making builds.
+var features = []string{
+	"buildTimeout",
+	"envProfile",
+	"expandEnv",
+	"exportModes",
+}
+
+// Capabilities lists the build commands the agent supports, prefixed by
+// "command:", and its features, prefixed by "feature:".
+func Capabilities() []string {
+	capabilities := make([]string, 0)
+	for name := range Executors() {
+		capabilities = append(capabilities, "command:"+name)
+	}
+	for _, feature := range features {
+		capabilities = append(capabilities, "feature:"+feature)
+	}
+	if config != nil && config.ExecBackend == ExecBackendContainer {
+		capabilities = append(capabilities, "feature:containerExecBackend")
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
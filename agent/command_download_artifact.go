@@ -26,7 +26,7 @@ func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error
 	if err != nil {
 		return err
 	}
-	absChecksumFile := filepath.Join(s.wd, cmd.Args["checksumFile"])
+	absChecksumFile := filepath.Join(s.wd, s.arg(cmd, "checksumFile"))
 	err = s.artifacts.DownloadFile(checksumURL, absChecksumFile)
 	if err != nil {
 		return err
@@ -37,10 +37,11 @@ func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error
 		return err
 	}
 	srcPath := cmd.Args["src"]
-	absDestPath := filepath.Join(s.wd, cmd.Args["dest"])
+	dest := s.arg(cmd, "dest")
+	absDestPath := filepath.Join(s.wd, dest)
 	if cmd.Name == protocol.CommandDownloadDir {
 		_, fname := filepath.Split(srcPath)
-		absDestPath = filepath.Join(s.wd, cmd.Args["dest"], fname)
+		absDestPath = filepath.Join(s.wd, dest, fname)
 	}
 	err = s.artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
 	if err == nil {
@@ -18,7 +18,11 @@ package agent
 
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
-	"os/exec"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
@@ -26,30 +30,159 @@ func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
 	if err != nil {
 		return err
 	}
-	execCmd := exec.Command(cmd.Args["command"], args...)
-	execCmd.Env = s.Env()
-	execCmd.Stdout = s.secrets
-	execCmd.Stderr = s.secrets
-	execCmd.Dir = s.wd
-	done := make(chan error)
-	if err := execCmd.Start(); err != nil {
+	if s.expandEnv(cmd) {
+		for i, arg := range args {
+			args[i] = s.ExpandEnv(arg)
+		}
+	}
+	console := stream.NewSyncWriter(s.secrets)
+	errConsole := console
+	if s.stderr != nil {
+		errConsole = stream.NewSyncWriter(s.stderr)
+	}
+	stderrPrefix, ok := cmd.Args["stderrPrefix"]
+	if !ok {
+		stderrPrefix = config.StderrPrefix
+	}
+
+	stdout, err := makeExecOutput(s, console, "", cmd.Args["stdoutFile"])
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	stderr, err := makeExecOutput(s, errConsole, stderrPrefix, cmd.Args["stderrFile"])
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	stdin, err := makeExecInput(s, cmd)
+	if err != nil {
 		return err
 	}
+	if closer, ok := stdin.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	backend, err := getExecBackend()
+	if err != nil {
+		return err
+	}
+	tty := cmd.Args["tty"] == "true"
+	execCmd, kill, err := backend.command(s, s.arg(cmd, "command"), args, tty)
+	if err != nil {
+		return err
+	}
+	limits, err := backend.limit(s, execCmd)
+	if err != nil {
+		return err
+	}
+	defer limits.release()
+	var wait func() error
+	if tty {
+		if stdin != nil {
+			return Err("exec with tty does not accept stdin or stdinFile")
+		}
+		// a terminal has one output, stderr shows up on stdout
+		wait, err = startWithTty(execCmd, stdout)
+	} else {
+		execCmd.Stdin = stdin
+		execCmd.Stdout = stdout
+		execCmd.Stderr = stderr
+		wait, err = execCmd.Wait, execCmd.Start()
+	}
+	if err != nil {
+		return err
+	}
+	done := make(chan error)
 	go func() {
-		done <- execCmd.Wait()
+		done <- wait()
 	}()
 
 	select {
 	case <-s.cancel:
 		s.debugLog("received cancel signal")
 		LogInfo("kill process(%v) %v", execCmd.Process, cmd.Args)
-		if err := execCmd.Process.Kill(); err != nil {
+		if err := kill(); err != nil {
 			LogInfo("Kill command %v failed, error: %v\n", cmd.Args, err)
 		} else {
 			LogInfo("process %v is killed", execCmd.Process)
 		}
 		return Err("%v is canceled", cmd.Args)
 	case err := <-done:
-		return err
+		return limits.explain(err)
+	}
+}
+
+// makeExecInput returns the stdin of a process: the "stdin" arg content or
+// the "stdinFile" in working directory. Without either one, a process
+// reading its stdin gets EOF immediately instead of waiting on the agent's.
+func makeExecInput(s *BuildSession, cmd *protocol.BuildCommand) (io.Reader, error) {
+	content, hasContent := cmd.Args["stdin"]
+	file := cmd.Args["stdinFile"]
+	if hasContent && file != "" {
+		return nil, Err("exec accepts only one of stdin and stdinFile")
+	}
+	if hasContent {
+		return strings.NewReader(content), nil
+	}
+	if file != "" {
+		path, err := s.sandboxPath(file)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(path)
+	}
+	// nil makes the process read from the null device
+	return nil, nil
+}
+
+type execOutput struct {
+	*stream.LineWriter
+	ansi *stream.AnsiWriter
+	file *os.File
+}
+
+// makeExecOutput assembles one output stream of a process into lines for
+// the console, tagging each line with prefix, and also saves the stream,
+// with secrets masked, to file when file is not empty.
+func makeExecOutput(s *BuildSession, console io.Writer, prefix, file string) (*execOutput, error) {
+	var w io.Writer = console
+	if prefix != "" {
+		w = stream.NewPrefixWriter(w, func() []byte { return []byte(prefix) })
+	}
+	ansi := stream.NewAnsiWriter(w, config.ConsoleAnsi)
+	w = ansi
+
+	output := &execOutput{ansi: ansi}
+	if file != "" {
+		path, err := s.sandboxPath(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := Mkdirs(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		output.file = f
+		w = io.MultiWriter(w, s.secrets.Filter(f))
+	}
+	output.LineWriter = stream.NewLineWriter(w, ConsoleLineFlushTimeout)
+	return output, nil
+}
+
+func (o *execOutput) Close() error {
+	err := o.LineWriter.Close()
+	if err2 := o.ansi.Close(); err == nil {
+		err = err2
+	}
+	if o.file != nil {
+		if err2 := o.file.Close(); err == nil {
+			err = err2
+		}
 	}
+	return err
 }
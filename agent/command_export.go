@@ -21,24 +21,72 @@ import (
 	"os"
 )
 
+const (
+	ExportSet     = "set"
+	ExportUnset   = "unset"
+	ExportPrepend = "prepend"
+	ExportAppend  = "append"
+)
+
+// CommandExport sets environment variable "name" to "value" for the
+// following commands, or prints it without "value". The "mode" arg
+// changes it to unset the variable, or to prepend or append "value" to it
+// with the path list separator, e.g. for PATH.
 func CommandExport(s *BuildSession, cmd *protocol.BuildCommand) error {
 	msg := "setting environment variable '%v' to value '%v'\n"
 	name := cmd.Args["name"]
+	mode := cmd.Args["mode"]
+	if mode == ExportUnset {
+		s.UnsetEnv(name)
+		delete(s.secureEnvs, name)
+		s.ConsoleLog("unsetting environment variable '%v'\n", name)
+		return nil
+	}
 	value, ok := cmd.Args["value"]
 	if !ok {
-		s.ConsoleLog(msg, name, os.Getenv(name))
+		value := s.lookupEnv(name)
+		if s.secureEnvs[name] && value != "" {
+			value = DefaultSecretMask
+		}
+		s.ConsoleLog(msg, name, value)
 		return nil
 	}
+	if s.expandEnv(cmd) {
+		value = s.ExpandEnv(value)
+	}
 	secure := cmd.Args["secure"]
 	displayValue := value
 	if secure == "true" {
 		displayValue = DefaultSecretMask
 	}
-	_, override := s.envs[name]
-	if override || os.Getenv(name) != "" {
-		msg = "overriding environment variable '%v' with value '%v'\n"
+	separator := string(os.PathListSeparator)
+	old := s.lookupEnv(name)
+	switch mode {
+	case "", ExportSet:
+		if s.hasEnv(name) {
+			msg = "overriding environment variable '%v' with value '%v'\n"
+		}
+	case ExportPrepend:
+		msg = "prepending environment variable '%v' with value '%v'\n"
+		if old != "" {
+			value = value + separator + old
+		}
+	case ExportAppend:
+		msg = "appending environment variable '%v' with value '%v'\n"
+		if old != "" {
+			value = old + separator + value
+		}
+	default:
+		return Err("Unknown export mode: %v", mode)
+	}
+	s.SetEnv(name, value)
+	// the value may be expanded into args of later commands, which
+	// masks it, see BuildSession.ExpandEnv
+	if secure == "true" {
+		s.secureEnvs[name] = true
+	} else if mode == "" || mode == ExportSet {
+		delete(s.secureEnvs, name)
 	}
-	s.envs[name] = value
-	s.ConsoleLog(msg, name, displayValue)
+	s.secrets.Write([]byte(Sprintf(msg, name, displayValue)))
 	return nil
 }
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"strconv"
+	"sync"
+)
+
+// CommandParallel runs its sub commands concurrently, at most
+// "maxConcurrency" of them at a time when the arg is given. Each sub
+// command writes console lines tagged with its own prefix, from the
+// "prefixes" list arg or "[n] " by default.
+//
+// A sub command runs in a session of its own, starting as passed: runIf of
+// the commands inside it matches the status of that sub command, and
+// exports and secrets made inside it do not reach the other sub commands.
+// The build timeout cancels and is reported in every sub command.
+func CommandParallel(s *BuildSession, cmd *protocol.BuildCommand) error {
+	maxConcurrency := len(cmd.SubCommands)
+	if arg, ok := cmd.Args["maxConcurrency"]; ok {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return Err("Invalid maxConcurrency: %v", arg)
+		}
+		if n < maxConcurrency {
+			maxConcurrency = n
+		}
+	}
+	var prefixes []string
+	if _, ok := cmd.Args["prefixes"]; ok {
+		var err error
+		prefixes, err = cmd.ListArg("prefixes")
+		if err != nil {
+			return err
+		}
+	}
+
+	console := stream.NewSyncWriter(s.console)
+	var stderr *stream.SyncWriter
+	if s.stderr != nil {
+		stderr = stream.NewSyncWriter(s.stderr)
+	}
+	sessions := make([]*BuildSession, len(cmd.SubCommands))
+	for i, sub := range cmd.SubCommands {
+		prefix := Sprintf("[%v] ", i+1)
+		if i < len(prefixes) {
+			prefix = prefixes[i]
+		}
+		sessions[i] = s.parallelSession(sub, console, stderr, prefix)
+	}
+
+	slots := make(chan bool, maxConcurrency)
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		slots <- true
+		wg.Add(1)
+		go func(session *BuildSession) {
+			defer func() {
+				session.console.Close()
+				<-slots
+				wg.Done()
+			}()
+			session.ProcessCommand()
+		}(session)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, session := range sessions {
+		if session.buildStatus == protocol.BuildFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return Err("%v of %v parallel commands failed", failed, len(sessions))
+	}
+	return nil
+}
+
+func (s *BuildSession) parallelSession(cmd *protocol.BuildCommand, console, stderr *stream.SyncWriter, prefix string) *BuildSession {
+	envs := make(map[string]*string, len(s.envs))
+	for k, v := range s.envs {
+		envs[k] = v
+	}
+	secureEnvs := make(map[string]bool, len(s.secureEnvs))
+	for k, v := range s.secureEnvs {
+		secureEnvs[k] = v
+	}
+	prefixed := stream.NewPrefixWriter(console, func() []byte { return []byte(prefix) })
+	lines := stream.NewLineWriter(prefixed, ConsoleLineFlushTimeout)
+	secrets := s.secrets.Fork(lines)
+	session := &BuildSession{
+		buildId:               s.buildId,
+		console:               lines,
+		artifacts:             s.artifacts,
+		artifactUploadBaseURL: s.artifactUploadBaseURL,
+		send:                  s.send,
+		envs:                  envs,
+		secureEnvs:            secureEnvs,
+		secrets:               secrets,
+		echo:                  s.echo.Fork(secrets),
+		rootDir:               s.rootDir,
+		executors:             s.executors,
+		command:               cmd,
+		buildStatus:           protocol.BuildPassed,
+		cancel:                s.cancel,
+		timeout:               s.timeout,
+		timedOut:              s.timedOut,
+		done:                  make(chan bool),
+	}
+	if stderr != nil {
+		session.stderr = secrets.Filter(stderr)
+	}
+	return session
+}
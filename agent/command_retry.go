@@ -0,0 +1,67 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"strconv"
+	"time"
+)
+
+// CommandRetry runs its sub commands like compose, and runs them all again
+// when one fails, up to "attempts" times. The "delay" between attempts is
+// multiplied by "backoff" after every attempt. The build fails only when
+// the last attempt fails. Every attempt is logged before it runs.
+func CommandRetry(s *BuildSession, cmd *protocol.BuildCommand) error {
+	attempts, err := strconv.Atoi(cmd.Args["attempts"])
+	if err != nil || attempts < 1 {
+		return Err("Invalid attempts: %v", cmd.Args["attempts"])
+	}
+	var delay time.Duration
+	if arg, ok := cmd.Args["delay"]; ok {
+		delay, err = time.ParseDuration(arg)
+		if err != nil || delay < 0 {
+			return Err("Invalid delay: %v", arg)
+		}
+	}
+	backoff := 1.0
+	if arg, ok := cmd.Args["backoff"]; ok {
+		backoff, err = strconv.ParseFloat(arg, 64)
+		if err != nil || backoff < 1 {
+			return Err("Invalid backoff: %v", arg)
+		}
+	}
+
+	status := s.buildStatus
+	for attempt := 1; ; attempt++ {
+		s.ConsoleLog("Attempt %v of %v\n", attempt, attempts)
+		err = CommandCompose(s, cmd)
+		if err == nil || attempt == attempts || s.isCanceled() {
+			return err
+		}
+		// only the last attempt decides the build status
+		s.buildStatus = status
+		s.warn("Retry in %v.", delay)
+		select {
+		case <-s.cancel:
+			s.debugLog("received cancel signal")
+			return nil
+		case <-time.After(delay):
+		}
+		delay = time.Duration(float64(delay) * backoff)
+	}
+}
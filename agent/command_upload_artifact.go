@@ -26,8 +26,8 @@ import (
 )
 
 func CommandUploadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error {
-	src := cmd.Args["src"]
-	destDir := cmd.Args["dest"]
+	src := s.arg(cmd, "src")
+	destDir := s.arg(cmd, "dest")
 	ignoreUnmatchError := cmd.Args["ignoreUnmatchError"] == "true"
 
 	absSrc := filepath.Join(s.wd, src)
@@ -17,13 +17,14 @@
 package agent
 
 import (
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-	"crypto/tls"
 )
 
 type Config struct {
@@ -31,9 +32,11 @@ type Config struct {
 	SendMessageTimeout time.Duration
 	ServerUrl          *url.URL
 	ServerHostAndPort  string
+	ProxyUrl           *url.URL
 	ContextPath        string
 	WebSocketPath      string
 	RegistrationPath   string
+	TokenPath          string
 	WorkingDir         string
 	LogDir             string
 	ConfigDir          string
@@ -45,14 +48,67 @@ type Config struct {
 	AgentAutoRegisterElasticAgentId  string
 	AgentAutoRegisterElasticPluginId string
 
-	GoServerCAFile      string
-	AgentPrivateKeyFile string
-	AgentCertFile       string
-	AgentIdFile         string
-	OutputDebugLog      bool
+	GoServerCAFile        string
+	GoServerCABundle      string
+	GoServerCAFingerprint string
+	AllowLegacyServerCert bool
+	AgentPrivateKeyFile   string
+	AgentCertFile         string
+	AgentTokenFile        string
+	RegistrationMode      string
+	CertExpiryWarning     time.Duration
+	RegistrationMaxWait   time.Duration
+	AgentIdFile           string
+	EnvProfileFile        string
+	OutputDebugLog        bool
+
+	ConsoleAnsi  string
+	ExportCIEnv  bool
+	ConsoleTerm  string
+	StderrPrefix string
+	ExpandEnv    bool
+
+	BuildTimeout time.Duration
+	BuildLimits  *BuildLimits
+
+	Connection *ServerConnection
+
+	ExecBackend      string
+	ContainerRuntime string
+	ContainerImage   string
+
+	PluginsDir string
+}
+
+// BuildLimits are resource limits applied to every build process, zero
+// means no limit. Memory and CgroupDir need cgroup v2.
+type BuildLimits struct {
+	AddressSpace uint64
+	OpenFiles    uint64
+	CPUTime      uint64
+	Processes    uint64
+	Memory       uint64
+	CgroupDir    string
 }
 
+// ServerConnection tunes connections to Go server, zero timeout means no
+// timeout.
+type ServerConnection struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	WriteTimeout          time.Duration
+	KeepAlive             time.Duration
+	MaxIdleConns          int
+}
+
+// configWarnings are the problems LoadConfig found in the environment,
+// logged by Initialize once the logger is made.
+var configWarnings []string
+
 func LoadConfig() *Config {
+	configWarnings = nil
 	gocdServerURL := readEnv("GOCD_SERVER_URL", "https://localhost:8154/go")
 	os.Setenv("GO_SERVER_URL", gocdServerURL)
 	serverUrl, err := url.Parse(gocdServerURL)
@@ -60,6 +116,13 @@ func LoadConfig() *Config {
 		panic(err)
 	}
 	serverUrl.Scheme = "https"
+	var proxyUrl *url.URL
+	if proxy := os.Getenv("GOCD_AGENT_PROXY"); proxy != "" {
+		proxyUrl, err = url.Parse(proxy)
+		if err != nil {
+			panic(Sprintf("GOCD_AGENT_PROXY is invalid: %v", err))
+		}
+	}
 	hostname, _ := os.Hostname()
 	wd, err := filepath.Abs(os.Getenv("GOCD_AGENT_WORKING_DIR"))
 	if err != nil {
@@ -67,18 +130,27 @@ func LoadConfig() *Config {
 	}
 	wd = filepath.Clean(wd)
 	configDir := filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"))
-	return &Config{
+	c := &Config{
 		Hostname:                         hostname,
 		SendMessageTimeout:               120 * time.Second,
 		ServerUrl:                        serverUrl,
 		ServerHostAndPort:                serverUrl.Host,
+		ProxyUrl:                         proxyUrl,
 		WorkingDir:                       wd,
 		LogDir:                           os.Getenv("GOCD_AGENT_LOG_DIR"),
 		ConfigDir:                        configDir,
 		GoServerCAFile:                   filepath.Join(configDir, "go-server-ca.pem"),
+		GoServerCABundle:                 os.Getenv("GOCD_SERVER_CA_BUNDLE"),
+		GoServerCAFingerprint:            os.Getenv("GOCD_SERVER_CA_FINGERPRINT"),
+		AllowLegacyServerCert:            os.Getenv("GOCD_SERVER_ALLOW_LEGACY_CERT") != "",
 		AgentPrivateKeyFile:              filepath.Join(configDir, "agent-private-key.pem"),
 		AgentCertFile:                    filepath.Join(configDir, "agent-cert.pem"),
+		AgentTokenFile:                   filepath.Join(configDir, "agent-token"),
+		RegistrationMode:                 readEnv("GOCD_AGENT_REGISTRATION_MODE", RegistrationModeCert),
+		CertExpiryWarning:                readEnvDuration("GOCD_AGENT_CERT_EXPIRY_WARNING", 30*24*time.Hour),
+		RegistrationMaxWait:              readEnvDuration("GOCD_AGENT_REGISTRATION_MAX_WAIT", 0),
 		AgentIdFile:                      filepath.Join(configDir, "agent-id"),
+		EnvProfileFile:                   readEnv("GOCD_AGENT_ENV_PROFILE", filepath.Join(configDir, "env-profile")),
 		AgentAutoRegisterKey:             os.Getenv("GOCD_AGENT_AUTO_REGISTER_KEY"),
 		AgentAutoRegisterResources:       os.Getenv("GOCD_AGENT_AUTO_REGISTER_RESOURCES"),
 		AgentAutoRegisterEnvironments:    os.Getenv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS"),
@@ -87,14 +159,48 @@ func LoadConfig() *Config {
 		OutputDebugLog:                   os.Getenv("DEBUG") != "",
 		WebSocketPath:                    readEnv("GOCD_SERVER_WEB_SOCKET_PATH", "/agent-websocket"),
 		RegistrationPath:                 readEnv("GOCD_SERVER_REGISTRATION_PATH", "/admin/agent"),
-		IpAddress:                        lookupIpAddress(serverUrl.Host),
+		TokenPath:                        readEnv("GOCD_SERVER_TOKEN_PATH", "/admin/agent/token"),
+		ConsoleAnsi:                      readEnvChoice("GOCD_AGENT_CONSOLE_ANSI", stream.AnsiKeep, stream.AnsiStrip, stream.AnsiNormalize),
+		ExportCIEnv:                      os.Getenv("GOCD_AGENT_EXPORT_CI_ENV") != "",
+		ConsoleTerm:                      readEnv("GOCD_AGENT_CONSOLE_TERM", "dumb"),
+		StderrPrefix:                     os.Getenv("GOCD_AGENT_STDERR_PREFIX"),
+		ExpandEnv:                        os.Getenv("GOCD_AGENT_EXPAND_ENV") != "",
+		BuildTimeout:                     readEnvDuration("GOCD_AGENT_BUILD_TIMEOUT", 0),
+		BuildLimits: &BuildLimits{
+			AddressSpace: readEnvUint("GOCD_AGENT_BUILD_LIMIT_ADDRESS_SPACE", 0),
+			OpenFiles:    readEnvUint("GOCD_AGENT_BUILD_LIMIT_OPEN_FILES", 0),
+			CPUTime:      readEnvUint("GOCD_AGENT_BUILD_LIMIT_CPU_TIME", 0),
+			Processes:    readEnvUint("GOCD_AGENT_BUILD_LIMIT_PROCESSES", 0),
+			Memory:       readEnvUint("GOCD_AGENT_BUILD_LIMIT_MEMORY", 0),
+			CgroupDir:    os.Getenv("GOCD_AGENT_BUILD_CGROUP_DIR"),
+		},
+		Connection: &ServerConnection{
+			DialTimeout:           readEnvDuration("GOCD_AGENT_DIAL_TIMEOUT", 30*time.Second),
+			TLSHandshakeTimeout:   readEnvDuration("GOCD_AGENT_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+			ResponseHeaderTimeout: readEnvDuration("GOCD_AGENT_RESPONSE_HEADER_TIMEOUT", 2*time.Minute),
+			IdleConnTimeout:       readEnvDuration("GOCD_AGENT_IDLE_CONN_TIMEOUT", 90*time.Second),
+			WriteTimeout:          readEnvDuration("GOCD_AGENT_WRITE_TIMEOUT", 2*time.Minute),
+			KeepAlive:             readEnvDuration("GOCD_AGENT_KEEP_ALIVE", 30*time.Second),
+			MaxIdleConns:          readEnvInt("GOCD_AGENT_MAX_IDLE_CONNS", 10),
+		},
+		ExecBackend:      readEnv("GOCD_AGENT_EXEC_BACKEND", ExecBackendLocal),
+		ContainerRuntime: readEnv("GOCD_AGENT_CONTAINER_RUNTIME", "docker"),
+		ContainerImage:   os.Getenv("GOCD_AGENT_CONTAINER_IMAGE"),
+		PluginsDir:       filepath.Join(wd, readEnv("GOCD_AGENT_PLUGINS_DIR", "plugins")),
+	}
+	// the container backend limits memory by itself
+	if c.BuildLimits.Memory > 0 && c.BuildLimits.CgroupDir == "" && c.ExecBackend != ExecBackendContainer {
+		configWarnings = append(configWarnings, "GOCD_AGENT_BUILD_LIMIT_MEMORY is ignored without GOCD_AGENT_BUILD_CGROUP_DIR")
 	}
+	return c
 }
 
-func lookupIpAddress(host string) string {
-	conn, err := tls.Dial("tcp", host, &tls.Config{
-		InsecureSkipVerify: true,
-	})
+func lookupIpAddress(host string, proxyUrl *url.URL) string {
+	proxy, err := proxyFor(proxyUrl, host)
+	if err != nil {
+		return checkAllInterfaces()
+	}
+	conn, err := dial(host, proxy)
 	if err != nil {
 		return checkAllInterfaces()
 	}
@@ -133,6 +239,10 @@ func (c *Config) RegistrationURL() (*url.URL, error) {
 	return c.MakeFullServerURL(c.RegistrationPath)
 }
 
+func (c *Config) TokenURL() (*url.URL, error) {
+	return c.MakeFullServerURL(c.TokenPath)
+}
+
 func (c *Config) MakeFullServerURL(u string) (*url.URL, error) {
 	if strings.HasPrefix(u, "/") {
 		return url.Parse(Join("/", c.HttpsServerURL(), u))
@@ -145,6 +255,60 @@ func (c *Config) IsElasticAgent() bool {
 	return config.AgentAutoRegisterElasticPluginId == ""
 }
 
+func readEnvUint(varname string, defaultVal uint64) uint64 {
+	val := os.Getenv(varname)
+	if val == "" {
+		return defaultVal
+	}
+	i, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		configWarnings = append(configWarnings, Sprintf("%v=%v is invalid, using %v: %v", varname, val, defaultVal, err))
+		return defaultVal
+	}
+	return i
+}
+
+func readEnvInt(varname string, defaultVal int) int {
+	val := os.Getenv(varname)
+	if val == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		configWarnings = append(configWarnings, Sprintf("%v=%v is invalid, using %v: %v", varname, val, defaultVal, err))
+		return defaultVal
+	}
+	return i
+}
+
+func readEnvDuration(varname string, defaultVal time.Duration) time.Duration {
+	val := os.Getenv(varname)
+	if val == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		configWarnings = append(configWarnings, Sprintf("%v=%v is invalid, using %v: %v", varname, val, defaultVal, err))
+		return defaultVal
+	}
+	return d
+}
+
+// readEnvChoice reads varname, which is defaultVal or one of choices.
+func readEnvChoice(varname string, defaultVal string, choices ...string) string {
+	val := readEnv(varname, defaultVal)
+	if val == defaultVal {
+		return val
+	}
+	for _, choice := range choices {
+		if val == choice {
+			return val
+		}
+	}
+	configWarnings = append(configWarnings, Sprintf("%v=%v is unknown, using %v", varname, val, defaultVal))
+	return defaultVal
+}
+
 func readEnv(varname string, defaultVal string) string {
 	val := os.Getenv(varname)
 	if val == "" {
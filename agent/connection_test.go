@@ -0,0 +1,136 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"crypto/tls"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func withSlowServer(t *testing.T, delay, timeout time.Duration) func() {
+	_, cleanup := withCAFile(t)
+	assert.Nil(t, ReadGoServerCACert())
+	conn := GetConfig().Connection
+	old := conn.ResponseHeaderTimeout
+	conn.ResponseHeaderTimeout = timeout
+	goServer.SetResponseDelay(delay)
+	return func() {
+		goServer.SetResponseDelay(0)
+		conn.ResponseHeaderTimeout = old
+		cleanup()
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	defer withSlowServer(t, time.Second, 50*time.Millisecond)()
+	client, err := GoServerRemoteClient(false)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = client.Get(goServerUrl + server.StatusPath)
+	assert.NotNil(t, err)
+	assert.True(t, contains(err.Error(), "timeout awaiting response headers"), err.Error())
+	assert.True(t, time.Since(start) < time.Second, time.Since(start))
+}
+
+func TestBuildConsoleShouldNotBlockOnSlowServer(t *testing.T) {
+	defer withSlowServer(t, time.Second, 50*time.Millisecond)()
+	client, err := GoServerRemoteClient(false)
+	assert.Nil(t, err)
+	u, err := url.Parse(goServerUrl + server.ConsoleLogPath + "/builds/slow")
+	assert.Nil(t, err)
+
+	start := time.Now()
+	console := MakeBuildConsole(client, u)
+	console.Write([]byte("hello\n"))
+	assert.Nil(t, console.Close())
+	assert.True(t, time.Since(start) < time.Second, time.Since(start))
+}
+
+func TestWriteTimeoutShouldFailStalledUpload(t *testing.T) {
+	defer withSlowServer(t, 3*time.Second, 0)()
+	conn := GetConfig().Connection
+	old := conn.WriteTimeout
+	conn.WriteTimeout = 100 * time.Millisecond
+	defer func() {
+		conn.WriteTimeout = old
+	}()
+	client, err := GoServerRemoteClient(false)
+	assert.Nil(t, err)
+
+	// large enough to fill the socket buffers while server is not reading
+	body := io.LimitReader(zeros{}, 256<<20)
+	start := time.Now()
+	_, err = client.Post(goServerUrl+server.ArtifactsPath+"/builds/stalled", "application/octet-stream", body)
+	assert.NotNil(t, err)
+	assert.True(t, contains(err.Error(), "i/o timeout"), err.Error())
+	assert.True(t, time.Since(start) < 3*time.Second, time.Since(start))
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		// accept connections, and never respond
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	config := GetConfig()
+	oldHost, oldTimeout := config.ServerHostAndPort, config.Connection.TLSHandshakeTimeout
+	config.ServerHostAndPort = l.Addr().String()
+	config.Connection.TLSHandshakeTimeout = 50 * time.Millisecond
+	defer func() {
+		config.ServerHostAndPort, config.Connection.TLSHandshakeTimeout = oldHost, oldTimeout
+	}()
+
+	start := time.Now()
+	_, err = DialGoServer(&tls.Config{InsecureSkipVerify: true})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second, time.Since(start))
+}
+
+func TestInvalidConnectionSettingsShouldFallBackToDefaults(t *testing.T) {
+	os.Setenv("GOCD_AGENT_DIAL_TIMEOUT", "soon")
+	defer os.Unsetenv("GOCD_AGENT_DIAL_TIMEOUT")
+	os.Setenv("GOCD_AGENT_MAX_IDLE_CONNS", "many")
+	defer os.Unsetenv("GOCD_AGENT_MAX_IDLE_CONNS")
+
+	conn := LoadConfig().Connection
+	assert.Equal(t, 30*time.Second, conn.DialTimeout)
+	assert.Equal(t, 10, conn.MaxIdleConns)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvProfile is a file of environment variables set in every build before
+// the build's own exports, e.g. for toolchains installed on the agent:
+//
+//	# comment
+//	JAVA_HOME=/opt/jdk
+//	PATH=${JAVA_HOME}/bin:${PATH}
+//	secure NPM_TOKEN=xxx
+//
+// ${NAME} in values is replaced by the value of NAME set by the lines
+// above or inherited by the agent. Values of secure variables are masked
+// in console log. The file is read again when it is changed.
+type EnvProfile struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	entries []envProfileEntry
+}
+
+type envProfileEntry struct {
+	name   string
+	value  string
+	secure bool
+}
+
+var envProfile = &EnvProfile{}
+
+// Apply sets the variables in the profile at path to the build session.
+// When the file is changed but can't be loaded, the variables loaded last
+// time are applied, and the error is returned.
+func (p *EnvProfile) Apply(s *BuildSession, path string) error {
+	entries, err := p.load(path)
+	for _, e := range entries {
+		value := s.ExpandEnv(e.value)
+		if e.secure && value != "" {
+			s.secrets.Substitutions[value] = DefaultSecretMask
+		}
+		s.SetEnv(e.name, value)
+		if e.secure {
+			s.secureEnvs[e.name] = true
+		} else {
+			delete(s.secureEnvs, e.name)
+		}
+	}
+	return err
+}
+
+func (p *EnvProfile) load(path string) ([]envProfileEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		p.path, p.entries = path, nil
+		p.modTime, p.size = time.Time{}, 0
+		return nil, nil
+	} else if err != nil {
+		return p.entries, err
+	}
+	if p.path == path && p.modTime.Equal(info.ModTime()) && p.size == info.Size() {
+		return p.entries, nil
+	}
+	entries, err := readEnvProfile(path)
+	if err != nil {
+		return p.entries, err
+	}
+	LogInfo("loaded env profile %v", path)
+	p.path, p.entries = path, entries
+	p.modTime, p.size = info.ModTime(), info.Size()
+	return entries, nil
+}
+
+func readEnvProfile(path string) ([]envProfileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []envProfileEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var e envProfileEntry
+		if strings.HasPrefix(line, "secure ") {
+			e.secure = true
+			line = strings.TrimSpace(line[len("secure "):])
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			return nil, Err("Invalid line %v in env profile %v: %v", n, path, scanner.Text())
+		}
+		e.name, e.value = line[:i], line[i+1:]
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
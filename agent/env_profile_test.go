@@ -0,0 +1,109 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useEnvProfile(t *testing.T, content string) func() {
+	dir, err := ioutil.TempDir("", "env-profile")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "env-profile")
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err)
+	old := GetConfig().EnvProfileFile
+	GetConfig().EnvProfileFile = path
+	return func() {
+		GetConfig().EnvProfileFile = old
+		os.RemoveAll(dir)
+	}
+}
+
+func buildConsoleLog(t *testing.T, commands ...*protocol.BuildCommand) string {
+	goServer.SendBuild(AgentId, buildId, commands...)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	os.Truncate(goServer.ConsoleLogFile(buildId), 0)
+	return trimTimestamp(log)
+}
+
+func TestEnvProfile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("TEST_PROFILE_INHERITED", "inherited")
+	defer os.Setenv("TEST_PROFILE_INHERITED", "")
+	defer useEnvProfile(t, `# toolchains
+TEST_PROFILE_HOME=/opt/tool
+
+TEST_PROFILE_PATH=${TEST_PROFILE_HOME}/bin:${TEST_PROFILE_INHERITED}
+secure TEST_PROFILE_TOKEN=thisissecret
+TEST_PROFILE_OVERRIDE=profile
+`)()
+
+	log := buildConsoleLog(t,
+		protocol.ExportCommand("TEST_PROFILE_OVERRIDE", "build", "false"),
+		protocol.ExecCommand("bash", "-c", "echo $TEST_PROFILE_PATH $TEST_PROFILE_TOKEN $TEST_PROFILE_OVERRIDE"),
+	)
+	expected := `overriding environment variable 'TEST_PROFILE_OVERRIDE' with value 'build'
+/opt/tool/bin:inherited ******** build
+`
+	assert.Equal(t, expected, log)
+}
+
+func TestEnvProfileShouldBeReloadedWhenChanged(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	defer useEnvProfile(t, "TEST_PROFILE_VAR=1\n")()
+	echoVar := protocol.ExecCommand("bash", "-c", "echo $TEST_PROFILE_VAR")
+
+	assert.Equal(t, "1\n", buildConsoleLog(t, echoVar))
+
+	err := ioutil.WriteFile(GetConfig().EnvProfileFile, []byte("TEST_PROFILE_VAR=22\n"), 0644)
+	assert.Nil(t, err)
+	assert.Equal(t, "22\n", buildConsoleLog(t, echoVar))
+
+	err = ioutil.WriteFile(GetConfig().EnvProfileFile, []byte("TEST_PROFILE_VAR 333\n"), 0644)
+	assert.Nil(t, err)
+	log := buildConsoleLog(t, echoVar)
+	assert.True(t, startWith(log, "WARN: Failed to load env profile, use the one loaded before: Invalid line 1"), log)
+	assert.True(t, contains(log, "\n22\n"), log)
+}
+
+func TestEnvProfileSecureValueShouldBeMaskedWhenExportedOrExpanded(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	defer useEnvProfile(t, "secure TEST_PROFILE_TOKEN=thisissecret\n")()
+
+	log := buildConsoleLog(t,
+		protocol.ExportCommand("TEST_PROFILE_TOKEN"),
+		protocol.ExecCommand("echo", "${TEST_PROFILE_TOKEN}").AddArg("expandEnv", "true"),
+	)
+	expected := `setting environment variable 'TEST_PROFILE_TOKEN' to value '********'
+********
+`
+	assert.Equal(t, expected, log)
+}
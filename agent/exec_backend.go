@@ -0,0 +1,162 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ExecBackendLocal     = "local"
+	ExecBackendContainer = "container"
+)
+
+// execBackend decides where the processes of exec build commands run.
+type execBackend interface {
+	// command returns the process to start, and the function to kill it
+	// once started
+	command(s *BuildSession, name string, args []string, tty bool) (*exec.Cmd, func() error, error)
+	// limit applies build limits to the process before it is started
+	limit(s *BuildSession, execCmd *exec.Cmd) (*limitsWatch, error)
+}
+
+var containers = &containerBackend{}
+
+func getExecBackend() (execBackend, error) {
+	switch config.ExecBackend {
+	case "", ExecBackendLocal:
+		return localBackend{}, nil
+	case ExecBackendContainer:
+		return containers, nil
+	}
+	return nil, Err("Unknown exec backend: %v", config.ExecBackend)
+}
+
+type localBackend struct{}
+
+func (localBackend) command(s *BuildSession, name string, args []string, tty bool) (*exec.Cmd, func() error, error) {
+	execCmd := exec.Command(name, args...)
+	execCmd.Env = s.Env()
+	execCmd.Dir = s.wd
+	return execCmd, func() error { return execCmd.Process.Kill() }, nil
+}
+
+func (localBackend) limit(s *BuildSession, execCmd *exec.Cmd) (*limitsWatch, error) {
+	return limitBuildCommand(s, execCmd)
+}
+
+// containerBackend runs processes in a new container of
+// config.ContainerImage, through a docker compatible command line
+// config.ContainerRuntime. Only the pipelines directory is mounted in the
+// container, so builds can't reach the agent config directory. Only the
+// processes of exec commands run in the container, the agent itself reads
+// and writes the host paths of exec stdin and output files, artifacts and
+// the other build commands, and runs plugins on the host.
+type containerBackend struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (b *containerBackend) command(s *BuildSession, name string, args []string, tty bool) (*exec.Cmd, func() error, error) {
+	if config.ContainerImage == "" {
+		return nil, nil, Err("GOCD_AGENT_CONTAINER_IMAGE is required by container exec backend")
+	}
+	pipelinesDir := filepath.Join(s.rootDir, "pipelines")
+	if !strings.HasPrefix(s.wd, pipelinesDir+string(filepath.Separator)) {
+		return nil, nil, Err("Working directory[%v] is outside of %v, which is the only directory mounted in build container.", s.wd, pipelinesDir)
+	}
+
+	b.mu.Lock()
+	b.count++
+	containerName := Sprintf("gocd-%v-%v-%v", AgentId, s.buildId, b.count)
+	b.mu.Unlock()
+
+	runArgs := []string{"run", "--rm", "-i",
+		"--name", containerName,
+		"-v", pipelinesDir + ":" + pipelinesDir,
+		"-w", s.wd,
+	}
+	if tty {
+		runArgs = append(runArgs, "-t")
+	}
+	// run as the agent user, so files made in the mounted pipelines
+	// directory stay writable by the agent, there are no user ids on
+	// windows
+	if runtime.GOOS != "windows" {
+		runArgs = append(runArgs, "--user", Sprintf("%v:%v", os.Getuid(), os.Getgid()))
+	}
+	runArgs = append(runArgs, containerLimitArgs(config.BuildLimits)...)
+	// values are passed through the runtime's environment, which keeps
+	// them out of the process list
+	envNames := make([]string, 0, len(s.envs))
+	for key, value := range s.envs {
+		if value != nil {
+			envNames = append(envNames, key)
+		}
+	}
+	sort.Strings(envNames)
+	for _, key := range envNames {
+		runArgs = append(runArgs, "-e", key)
+	}
+	runArgs = append(runArgs, config.ContainerImage, name)
+	runArgs = append(runArgs, args...)
+
+	execCmd := exec.Command(config.ContainerRuntime, runArgs...)
+	execCmd.Env = s.Env()
+	execCmd.Dir = s.wd
+	// killing the runtime command line process alone could leave the
+	// container running
+	kill := func() error {
+		if out, err := exec.Command(config.ContainerRuntime, "kill", containerName).CombinedOutput(); err != nil {
+			LogInfo("kill container %v failed: %v, %s", containerName, err, out)
+		}
+		return execCmd.Process.Kill()
+	}
+	return execCmd, kill, nil
+}
+
+func containerLimitArgs(limits *BuildLimits) []string {
+	var args []string
+	if limits == nil {
+		return args
+	}
+	if limits.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatUint(limits.Memory, 10))
+	}
+	if limits.Processes > 0 {
+		args = append(args, "--pids-limit", strconv.FormatUint(limits.Processes, 10))
+	}
+	if limits.OpenFiles > 0 {
+		args = append(args, "--ulimit", Sprintf("nofile=%v:%v", limits.OpenFiles, limits.OpenFiles))
+	}
+	if limits.CPUTime > 0 {
+		args = append(args, "--ulimit", Sprintf("cpu=%v:%v", limits.CPUTime, limits.CPUTime+1))
+	}
+	return args
+}
+
+// build limits are applied by the container runtime
+func (b *containerBackend) limit(s *BuildSession, execCmd *exec.Cmd) (*limitsWatch, error) {
+	return &limitsWatch{}, nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"testing"
+)
+
+func withContainerBackend() func() {
+	config := GetConfig()
+	config.ExecBackend = ExecBackendContainer
+	// prints the runtime command line instead of running a container
+	config.ContainerRuntime = "echo"
+	config.ContainerImage = "golang:alpine"
+	return func() {
+		config.ExecBackend = ExecBackendLocal
+		config.ContainerRuntime = "docker"
+		config.ContainerImage = ""
+	}
+}
+
+func TestContainerExecBackend(t *testing.T) {
+	defer withContainerBackend()()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("SECRET_TOKEN", "abcd", "true"),
+		protocol.ExecCommand("go", "test", "./...").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(trimTimestamp(log), "\n")
+	assert.Equal(t, "setting environment variable 'SECRET_TOKEN' to value '********'", lines[0])
+
+	pipelinesDir := Join("/", GetConfig().WorkingDir, "pipelines")
+	run := lines[1]
+	assert.True(t, startWith(run, Sprintf("run --rm -i --name gocd-%v-%v-", AgentId, buildId)), run)
+	assert.True(t, contains(run, Sprintf(" -v %v:%v -w %v ", pipelinesDir, pipelinesDir, wd)), run)
+	assert.True(t, contains(run, Sprintf(" --user %v:%v ", os.Getuid(), os.Getgid())), run)
+	assert.True(t, contains(run, " -e SECRET_TOKEN golang:alpine go test ./..."), run)
+	assert.True(t, !contains(run, "abcd"), run)
+}
+
+func TestContainerExecBackendShouldOnlyRunInPipelinesDir(t *testing.T) {
+	defer withContainerBackend()()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("cat", "config/agent-private-key.pem"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "which is the only directory mounted in build container"), log)
+}
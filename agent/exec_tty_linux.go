@@ -0,0 +1,135 @@
+// +build linux
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// startWithTty starts the process with a pseudo-terminal as its stdin,
+// stdout and stderr, and copies the terminal output to output. The
+// returned function waits for the process to exit and its output to be
+// copied.
+func startWithTty(execCmd *exec.Cmd, output io.Writer) (func() error, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	execCmd.Stdin = slave
+	execCmd.Stdout = slave
+	execCmd.Stderr = slave
+	if execCmd.SysProcAttr == nil {
+		execCmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	execCmd.SysProcAttr.Setsid = true
+	execCmd.SysProcAttr.Setctty = true
+	execCmd.SysProcAttr.Ctty = 0
+	err = execCmd.Start()
+	slave.Close()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	copied := make(chan bool)
+	go func() {
+		defer close(copied)
+		// reading master fails with EIO once the process exits
+		io.Copy(output, master)
+	}()
+	return func() error {
+		err := execCmd.Wait()
+		select {
+		case <-copied:
+		case <-time.After(ConsoleLineFlushTimeout):
+			// background processes may still hold the terminal open
+		}
+		master.Close()
+		<-copied
+		return err
+	}, nil
+}
+
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if err := setupTty(slave); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// setupTty keeps "\n" line endings in the output instead of the terminal
+// default "\r\n", and gives the terminal a size, as tools drawing progress
+// bars rely on it.
+func setupTty(tty *os.File) error {
+	var termios syscall.Termios
+	if err := ioctl(tty, syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+		return err
+	}
+	termios.Oflag &^= syscall.ONLCR
+	if err := ioctl(tty, syscall.TCSETS, unsafe.Pointer(&termios)); err != nil {
+		return err
+	}
+	winsize := struct{ row, col, x, y uint16 }{24, 80, 0, 0}
+	return ioctl(tty, syscall.TIOCSWINSZ, unsafe.Pointer(&winsize))
+}
+
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
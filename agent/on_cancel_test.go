@@ -18,6 +18,7 @@ package agent_test
 import (
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
 	"github.com/xli/assert"
 	"testing"
 	"time"
@@ -125,3 +126,95 @@ func TestCancelBuildWhenBuildIsHangingOnTestCommand(t *testing.T) {
 	expected := "hello before cancel\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
+
+func TestCancelParallelCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sleep", "5").SetOnCancel(echo("cancel 1")),
+			protocol.ExecCommand("sleep", "5"),
+			echo("should not process this echo"),
+		).AddArg("maxConcurrency", "2"),
+		echo("should not process this echo"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "[1] cancel 1\n", trimTimestamp(log))
+}
+
+func TestCancelRetryCommandBetweenAttempts(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand("3", protocol.FailCommand("foo")).AddArg("delay", "5s"),
+		echo("should not process this echo").RunIf("any"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "Attempt 1 of 3\nERROR: foo\nWARN: Retry in 5s.\n", trimTimestamp(log))
+}
+
+func TestCancelBuildWhenItTimesOut(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	GetConfig().BuildTimeout = 100 * time.Millisecond
+	defer func() {
+		GetConfig().BuildTimeout = 0
+	}()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").SetOnCancel(echo("cancel sleep")),
+		echo("should not process this echo").RunIf("any"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "cancel sleep\nERROR: Build timed out after 100ms and is canceled.\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestCancelBuildWhenItRunsLongerThanBuildTimeout(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	GetConfig().BuildTimeout = time.Minute
+	defer func() {
+		GetConfig().BuildTimeout = 0
+	}()
+	locator := "/builds/" + buildId
+	build := protocol.NewBuild(buildId, locator, locator,
+		server.ConsoleLogPath+locator,
+		server.ArtifactsPath+locator,
+		server.PropertiesPath+locator,
+		protocol.ExecCommand("sleep", "5"))
+	build.Timeout = 1
+	goServer.Send(AgentId, protocol.BuildMessage(build))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	// build timeout is in seconds, wait well longer than it
+	assert.Equal(t, "build Cancelled", stateLog.NextIn(5*time.Second))
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: Build timed out after 1s and is canceled.\n", trimTimestamp(log))
+}
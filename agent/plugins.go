@@ -0,0 +1,217 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// plugins are the executors PluginExecutors found in dir, which is read
+// again only after it is modified, e.g. a plugin is added or removed.
+// Agent looks up plugins in every ping to Go server. A directory modified
+// in the last second is not cached, its modification time may not change
+// for another change in the same clock tick.
+var plugins struct {
+	sync.Mutex
+	dir       string
+	modTime   time.Time
+	executors map[string]Executor
+}
+
+// PluginExecutors finds the external build command plugins in dir. A
+// plugin is an executable file named after the build command it runs,
+// with or without file extension. See protocol.PluginRequest and
+// protocol.PluginMessage for how the agent and plugins talk.
+func PluginExecutors(dir string) map[string]Executor {
+	executors := make(map[string]Executor)
+	info, err := os.Stat(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error.Printf("failed to read plugins directory %v: %v", dir, err)
+		}
+		return executors
+	}
+	plugins.Lock()
+	defer plugins.Unlock()
+	if plugins.dir == dir && plugins.modTime.Equal(info.ModTime()) {
+		for name, executor := range plugins.executors {
+			executors[name] = executor
+		}
+		return executors
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Error.Printf("failed to read plugins directory %v: %v", dir, err)
+		return executors
+	}
+	for _, f := range files {
+		if !isExecutableFile(f) {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		executors[name] = pluginExecutor(filepath.Join(dir, f.Name()))
+	}
+	if time.Since(info.ModTime()) > time.Second {
+		plugins.dir = dir
+		plugins.modTime = info.ModTime()
+		plugins.executors = make(map[string]Executor, len(executors))
+		for name, executor := range executors {
+			plugins.executors[name] = executor
+		}
+	}
+	return executors
+}
+
+func isExecutableFile(f os.FileInfo) bool {
+	if !f.Mode().IsRegular() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		switch strings.ToLower(filepath.Ext(f.Name())) {
+		case ".exe", ".bat", ".cmd":
+			return true
+		}
+		return false
+	}
+	return f.Mode()&0111 != 0
+}
+
+func pluginExecutor(path string) Executor {
+	return func(s *BuildSession, cmd *protocol.BuildCommand) error {
+		return runPlugin(s, cmd, path)
+	}
+}
+
+func runPlugin(s *BuildSession, cmd *protocol.BuildCommand, path string) error {
+	env := s.Env()
+	request, err := json.Marshal(&protocol.PluginRequest{
+		Name:             cmd.Name,
+		Args:             cmd.Args,
+		Env:              envMap(env),
+		WorkingDirectory: s.wd,
+	})
+	if err != nil {
+		return err
+	}
+
+	console := stream.NewSyncWriter(s.secrets)
+	errConsole := console
+	if s.stderr != nil {
+		errConsole = stream.NewSyncWriter(s.stderr)
+	}
+	stderr, err := makeExecOutput(s, errConsole, config.StderrPrefix, "")
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	execCmd := exec.Command(path)
+	execCmd.Env = env
+	execCmd.Dir = s.wd
+	execCmd.Stdin = bytes.NewReader(request)
+	execCmd.Stderr = stderr
+	stdout, err := execCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := execCmd.Start(); err != nil {
+		return err
+	}
+
+	var messages []*protocol.PluginMessage
+	var decodeErr error
+	// buffered, the reader must not block once cancel has returned
+	done := make(chan error, 1)
+	go func() {
+		dec := json.NewDecoder(stdout)
+		for {
+			var msg protocol.PluginMessage
+			if err := dec.Decode(&msg); err != nil {
+				if err != io.EOF {
+					decodeErr = err
+					io.Copy(ioutil.Discard, stdout)
+				}
+				break
+			}
+			if msg.Console != "" {
+				line := msg.Console
+				if !strings.HasSuffix(line, "\n") {
+					line += "\n"
+				}
+				console.Write([]byte(line))
+			}
+			messages = append(messages, &msg)
+		}
+		done <- execCmd.Wait()
+	}()
+
+	select {
+	case <-s.cancel:
+		s.debugLog("received cancel signal")
+		if err := execCmd.Process.Kill(); err != nil {
+			LogInfo("Kill plugin %v failed, error: %v\n", path, err)
+		}
+		return Err("%v is canceled", cmd.Name)
+	case err = <-done:
+	}
+
+	for _, msg := range messages {
+		for name, value := range msg.Export {
+			s.SetEnv(name, value)
+			delete(s.secureEnvs, name)
+		}
+		for _, name := range msg.Secure {
+			value, ok := msg.Export[name]
+			if !ok {
+				continue
+			}
+			s.secureEnvs[name] = true
+			if value != "" {
+				s.secrets.Substitutions[value] = DefaultSecretMask
+			}
+		}
+		if msg.Error != "" {
+			return Err("%v", msg.Error)
+		}
+	}
+	if decodeErr != nil {
+		return Err("invalid message from plugin %v: %v", path, decodeErr)
+	}
+	return err
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			m[kv[:i]] = kv[i+1:]
+		}
+	}
+	return m
+}
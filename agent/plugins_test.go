@@ -0,0 +1,159 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterExecutor("greet", func(s *BuildSession, cmd *protocol.BuildCommand) error {
+		s.ConsoleLog("hello %v\n", cmd.Args["name"])
+		return nil
+	})
+}
+
+func TestRegisteredExecutor(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.NewBuildCommand("greet").AddArg("name", "world"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world\n", trimTimestamp(log))
+}
+
+func TestRegisterExecutorShouldNotReplaceBuiltinCommands(t *testing.T) {
+	defer func() {
+		assert.NotNil(t, recover())
+	}()
+	RegisterExecutor(protocol.CommandExec, func(s *BuildSession, cmd *protocol.BuildCommand) error {
+		return nil
+	})
+}
+
+func writePlugin(t *testing.T, name, script string) {
+	dir := GetConfig().PluginsDir
+	err := writeFile(dir, name, "#!/bin/bash\n"+script)
+	assert.Nil(t, err)
+	err = os.Chmod(filepath.Join(dir, name), 0755)
+	assert.Nil(t, err)
+}
+
+func TestPluginExecutor(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	writePlugin(t, "hello.sh", `read request
+echo "$request" >&2
+echo '{"console": "hello from plugin thisissecret"}'
+echo '{"export": {"PLUGIN_VAR": "exported"}}'
+`)
+	defer os.RemoveAll(GetConfig().PluginsDir)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$"),
+		protocol.NewBuildCommand("hello").AddArg("greeting", "hi"),
+		protocol.ExecCommand("bash", "-c", "echo $PLUGIN_VAR"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = trimTimestamp(log)
+	// stderr and stdout of the plugin are not ordered relative to each other
+	assert.True(t, contains(log, `"name":"hello","args":{"greeting":"hi"}`), log)
+	assert.True(t, contains(log, "hello from plugin $$$\n"), log)
+	assert.True(t, contains(log, "\nexported\n"), log)
+}
+
+func TestPluginExecutorSecureExport(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	writePlugin(t, "login", `echo '{"export": {"PLUGIN_TOKEN": "pluginsecret", "PLUGIN_USER": "agent"}, "secure": ["PLUGIN_TOKEN"]}'`)
+	defer os.RemoveAll(GetConfig().PluginsDir)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.NewBuildCommand("login"),
+		protocol.ExportCommand("PLUGIN_TOKEN"),
+		protocol.ExecCommand("bash", "-c", "echo $PLUGIN_USER $PLUGIN_TOKEN"),
+		protocol.ExecCommand("echo", "${PLUGIN_TOKEN}").AddArg("expandEnv", "true"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'PLUGIN_TOKEN' to value '********'
+agent ********
+********
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestPluginExecutorShouldFailBuildWithPluginError(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	writePlugin(t, "broken", `echo '{"error": "disk is 100% full"}'`)
+	writePlugin(t, "crashed", `exit 2`)
+	defer os.RemoveAll(GetConfig().PluginsDir)
+
+	verify(t, []TestRow{
+		{protocol.NewBuildCommand("broken"), "ERROR: disk is 100% full\n", "Failed"},
+		{protocol.NewBuildCommand("crashed"), "ERROR: exit status 2\n", "Failed"},
+	})
+}
+
+func TestPluginExecutorsShouldBeReadAgainWhenPluginsDirChanged(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	dir := GetConfig().PluginsDir
+	writePlugin(t, "first", `exit 0`)
+	defer os.RemoveAll(dir)
+	modTime := time.Now().Add(-time.Minute)
+	err := os.Chtimes(dir, modTime, modTime)
+	assert.Nil(t, err)
+
+	_, ok := PluginExecutors(dir)["first"]
+	assert.True(t, ok)
+
+	writePlugin(t, "second", `exit 0`)
+	err = os.Chtimes(dir, modTime, modTime)
+	assert.Nil(t, err)
+	_, ok = PluginExecutors(dir)["second"]
+	assert.True(t, !ok, "unchanged plugins directory should not be read again")
+
+	modTime = modTime.Add(time.Second)
+	err = os.Chtimes(dir, modTime, modTime)
+	assert.Nil(t, err)
+	_, ok = PluginExecutors(dir)["second"]
+	assert.True(t, ok)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"golang.org/x/net/http/httpproxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// proxyFor returns the proxy for connecting to Go server at addr. The
+// explicit proxy is used when it is set, otherwise HTTPS_PROXY and
+// NO_PROXY environment variables decide.
+func proxyFor(proxy *url.URL, addr string) (*url.URL, error) {
+	if proxy != nil {
+		return proxy, nil
+	}
+	return httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+func (c *Config) Proxy(addr string) (*url.URL, error) {
+	return proxyFor(c.ProxyUrl, addr)
+}
+
+// DialGoServer makes a tls connection to Go server, tunneled by
+// CONNECT through the proxy when there is one.
+func DialGoServer(tlsConfig *tls.Config) (*tls.Conn, error) {
+	proxy, err := config.Proxy(config.ServerHostAndPort)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(config.ServerHostAndPort, proxy)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if timeout := config.Connection.TLSHandshakeTimeout; timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func dialer() *net.Dialer {
+	if config == nil || config.Connection == nil {
+		return &net.Dialer{}
+	}
+	return &net.Dialer{
+		Timeout:   config.Connection.DialTimeout,
+		KeepAlive: config.Connection.KeepAlive,
+	}
+}
+
+// dialContext dials Go server for http requests. A write to the connection
+// blocked longer than config.Connection.WriteTimeout fails, e.g. uploading
+// an artifact to a server that stopped reading the request body.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialer().DialContext(ctx, network, addr)
+	if err != nil || config == nil || config.Connection == nil || config.Connection.WriteTimeout == 0 {
+		return conn, err
+	}
+	return &writeTimeoutConn{Conn: conn, timeout: config.Connection.WriteTimeout}, nil
+}
+
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func dial(addr string, proxy *url.URL) (net.Conn, error) {
+	if proxy == nil {
+		return dialer().Dial("tcp", addr)
+	}
+	LogDebug("connect to %v through proxy %v", addr, proxy.Host)
+	conn, err := dialProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// nothing is sent after the response until the tunnel is used, so
+	// the reader buffers no more than the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, Err("Proxy %v refused to connect to %v: %v", proxy.Host, addr, resp.Status)
+	}
+	return conn, nil
+}
+
+func dialProxy(proxy *url.URL) (net.Conn, error) {
+	switch proxy.Scheme {
+	case "http":
+		return dialer().Dial("tcp", proxyAddr(proxy, "80"))
+	case "https":
+		return tls.DialWithDialer(dialer(), "tcp", proxyAddr(proxy, "443"), &tls.Config{ServerName: proxy.Hostname()})
+	default:
+		return nil, Err("Unsupported proxy scheme: %v", proxy.Scheme)
+	}
+}
+
+func proxyAddr(proxy *url.URL, defaultPort string) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	return net.JoinHostPort(proxy.Hostname(), defaultPort)
+}
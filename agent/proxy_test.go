@@ -0,0 +1,175 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bufio"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+// connectProxy tunnels CONNECT requests, and records their targets and
+// Proxy-Authorization headers.
+type connectProxy struct {
+	listener net.Listener
+	mu       sync.Mutex
+	tunnels  []string
+	auths    []string
+}
+
+func startConnectProxy(t *testing.T) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	p := &connectProxy{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	p.mu.Lock()
+	p.tunnels = append(p.tunnels, req.Host)
+	p.auths = append(p.auths, req.Header.Get("Proxy-Authorization"))
+	p.mu.Unlock()
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func (p *connectProxy) Tunnels() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.tunnels...)
+}
+
+func (p *connectProxy) Auths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.auths...)
+}
+
+func withProxy(t *testing.T, p *connectProxy) func() {
+	proxyUrl, err := url.Parse("http://agent:secret@" + p.listener.Addr().String())
+	assert.Nil(t, err)
+	GetConfig().ProxyUrl = proxyUrl
+	return func() {
+		GetConfig().ProxyUrl = nil
+		p.listener.Close()
+	}
+}
+
+func TestReadGoServerCACertThroughProxy(t *testing.T) {
+	_, cleanup := withCAFile(t)
+	defer cleanup()
+	p := startConnectProxy(t)
+	defer withProxy(t, p)()
+
+	assert.Nil(t, ReadGoServerCACert())
+	tunnels := p.Tunnels()
+	assert.Equal(t, 1, len(tunnels))
+	assert.Equal(t, GetConfig().ServerHostAndPort, tunnels[0])
+	assert.Equal(t, "Basic YWdlbnQ6c2VjcmV0", p.Auths()[0])
+}
+
+func TestRemoteClientThroughProxy(t *testing.T) {
+	_, cleanup := withCAFile(t)
+	defer cleanup()
+	p := startConnectProxy(t)
+	defer withProxy(t, p)()
+
+	assert.Nil(t, ReadGoServerCACert())
+	client, err := GoServerRemoteClient(false)
+	assert.Nil(t, err)
+	resp, err := client.Get(goServerUrl + server.StatusPath)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, len(p.Tunnels()))
+	assert.Equal(t, "Basic YWdlbnQ6c2VjcmV0", p.Auths()[1])
+}
+
+func TestBuildThroughProxy(t *testing.T) {
+	p := startConnectProxy(t)
+	defer withProxy(t, p)()
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+	// registration, websocket and console log
+	assert.True(t, len(p.Tunnels()) >= 3, p.Tunnels())
+}
+
+func TestDialThroughProxyRefused(t *testing.T) {
+	_, cleanup := withCAFile(t)
+	defer cleanup()
+	proxyUrl, err := url.Parse("socks5://127.0.0.1:1080")
+	assert.Nil(t, err)
+	GetConfig().ProxyUrl = proxyUrl
+	defer func() {
+		GetConfig().ProxyUrl = nil
+	}()
+
+	err = ReadGoServerCACert()
+	assert.NotNil(t, err)
+	assert.Equal(t, "Unsupported proxy scheme: socks5", err.Error())
+}
+
+func TestLoadConfigWithProxyShouldNotConnectToGoServer(t *testing.T) {
+	proxy := startConnectProxy(t)
+	defer proxy.listener.Close()
+	os.Setenv("GOCD_AGENT_PROXY", "http://"+proxy.listener.Addr().String())
+	defer os.Unsetenv("GOCD_AGENT_PROXY")
+
+	config := LoadConfig()
+	assert.Equal(t, proxy.listener.Addr().String(), config.ProxyUrl.Host)
+	assert.Equal(t, "", config.IpAddress)
+	assert.Equal(t, 0, len(proxy.Tunnels()))
+}
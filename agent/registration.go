@@ -17,26 +17,60 @@
 package agent
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 )
 
+var (
+	RegistrationPollInterval    = 10 * time.Second
+	RegistrationMaxPollInterval = 5 * time.Minute
+
+	// ErrRegistrationTimeout is returned when Go server has not approved
+	// the agent in config.RegistrationMaxWait.
+	ErrRegistrationTimeout = Err("agent registration is not approved in time")
+
+	errPendingApproval = Err("agent registration is pending approval")
+	pendingSince       time.Time
+)
+
+// ReadGoServerCACert saves the certificate chain presented by Go server
+// as the CA of Go server, when it is not saved yet. The chain must be
+// signed by a CA in config.GoServerCABundle, or have a certificate
+// matching config.GoServerCAFingerprint, when they are set. Otherwise the
+// chain is trusted on first use, and its fingerprints are logged for
+// operators to verify. A saved CA certificate is verified again against
+// config.GoServerCABundle and config.GoServerCAFingerprint at every
+// start, and fetched again when it does not match them.
 func ReadGoServerCACert() error {
 	_, err := os.Stat(config.GoServerCAFile)
 	if err == nil {
-		return nil
+		// the CA bundle or fingerprint may be configured after the CA
+		// certificate was saved
+		err = verifySavedGoServerCACert()
+		if err == nil {
+			return nil
+		}
+		LogInfo("WARN: saved Go server CA certificate %v is not trusted: %v, fetch it again", config.GoServerCAFile, err)
+		if err := os.Remove(config.GoServerCAFile); err != nil {
+			return err
+		}
 	}
 
 	LogInfo("fetching Go server[%v] CA certificate", config.ServerHostAndPort)
-	conn, err := tls.Dial("tcp", config.ServerHostAndPort, &tls.Config{
+	conn, err := DialGoServer(&tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
@@ -45,18 +79,104 @@ func ReadGoServerCACert() error {
 	}
 	defer conn.Close()
 	state := conn.ConnectionState()
-	certOut, err := os.Create(config.GoServerCAFile)
+	if err := verifyGoServerCertChain(state.PeerCertificates); err != nil {
+		logger.Error.Printf("refuse to trust Go server certificate: %v", err)
+		return err
+	}
+	var certOut bytes.Buffer
+	for i := 0; i < len(state.PeerCertificates); i++ {
+		pem.Encode(&certOut, &pem.Block{Type: "CERTIFICATE", Bytes: state.PeerCertificates[i].Raw})
+	}
+	if err := WriteFileAtomic(config.GoServerCAFile, certOut.Bytes(), 0644); err != nil {
+		logger.Error.Printf("failed to write %v: %s", config.GoServerCAFile, err)
+		return err
+	}
+	return nil
+}
+
+func verifySavedGoServerCACert() error {
+	if config.GoServerCABundle == "" && config.GoServerCAFingerprint == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(config.GoServerCAFile)
 	if err != nil {
-		logger.Error.Printf("failed to open %v for writing: %s", config.GoServerCAFile, err)
 		return err
 	}
-	defer certOut.Close()
-	for i:=0; i < len(state.PeerCertificates); i++ {
-		pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: state.PeerCertificates[i].Raw})
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, cert)
+	}
+	return verifyGoServerCertChain(chain)
+}
+
+func verifyGoServerCertChain(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return Err("Go server presented no certificate")
+	}
+	if config.GoServerCABundle == "" && config.GoServerCAFingerprint == "" {
+		for _, cert := range chain {
+			LogInfo("trust Go server certificate on first use, subject: %v, SHA-256 fingerprint: %v",
+				cert.Subject, CertFingerprint(cert))
+		}
+		return nil
+	}
+	if config.GoServerCABundle != "" {
+		bundle, err := ioutil.ReadFile(config.GoServerCABundle)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			return Err("no certificate found in CA bundle %v", config.GoServerCABundle)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err = chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		if err != nil {
+			return Err("Go server certificate is not signed by CA bundle %v: %v", config.GoServerCABundle, err)
+		}
+	}
+	if config.GoServerCAFingerprint != "" {
+		pin := normalizeFingerprint(config.GoServerCAFingerprint)
+		fingerprints := make([]string, len(chain))
+		for i, cert := range chain {
+			fingerprints[i] = CertFingerprint(cert)
+			if normalizeFingerprint(fingerprints[i]) == pin {
+				return nil
+			}
+		}
+		return Err("no Go server certificate matches fingerprint %v, presented: %v",
+			config.GoServerCAFingerprint, strings.Join(fingerprints, ", "))
 	}
 	return nil
 }
 
+// CertFingerprint is the SHA-256 fingerprint of cert, formatted like
+// openssl x509 -fingerprint -sha256 does.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = Sprintf("%02X", b)
+	}
+	return strings.Join(hexes, ":")
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+}
+
 func GoServerRootCAs() (*x509.CertPool, error) {
 	caCert, err := ioutil.ReadFile(config.GoServerCAFile)
 	if err != nil {
@@ -72,7 +192,7 @@ func GoServerRootCAs() (*x509.CertPool, error) {
 
 func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	certs := make([]tls.Certificate, 0)
-	if withClientCert {
+	if withClientCert && !isTokenRegistration() {
 		cert, err := tls.LoadX509KeyPair(config.AgentCertFile, config.AgentPrivateKeyFile)
 		if err != nil {
 			return nil, err
@@ -83,15 +203,53 @@ func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	serverName, err := extractServerDN(config.GoServerCAFile)
-	if err != nil {
-		return nil, err
-	}
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		Certificates: certs,
 		RootCAs:      roots,
-		ServerName:   serverName,
-	}, nil
+		ServerName:   config.ServerUrl.Hostname(),
+	}
+	if config.AllowLegacyServerCert {
+		// tls only matches the server name against subject alternative
+		// names, which certificates made by old Go servers don't have
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyServerCert(rawCerts, roots, tlsConfig.ServerName)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyServerCert verifies the certificate chain presented by Go server
+// like tls does, except that a certificate without any subject alternative
+// name is not verified against the server name.
+func verifyServerCert(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return Err("Go server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if len(leaf.DNSNames) == 0 && len(leaf.IPAddresses) == 0 {
+		LogDebug("Go server certificate[%v] has no subject alternative name, skip verifying server name %v",
+			leaf.Subject.CommonName, serverName)
+		opts.DNSName = ""
+	}
+	_, err := leaf.Verify(opts)
+	return err
 }
 
 func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
@@ -99,26 +257,127 @@ func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	conn := GetConfig().Connection
 	tr := &http.Transport{
-		TLSClientConfig: config,
+		TLSClientConfig:       config,
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		TLSHandshakeTimeout:   conn.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: conn.ResponseHeaderTimeout,
+		IdleConnTimeout:       conn.IdleConnTimeout,
+		MaxIdleConns:          conn.MaxIdleConns,
+		// all connections are to Go server
+		MaxIdleConnsPerHost: conn.MaxIdleConns,
+	}
+	if withClientCert && isTokenRegistration() {
+		header, err := agentTokenHeader()
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: &tokenTransport{transport: tr, header: header}}, nil
 	}
 	return &http.Client{Transport: tr}, nil
 }
 
+func proxy(req *http.Request) (*url.URL, error) {
+	return config.Proxy(req.URL.Host)
+}
+
+// Register makes sure the agent has Go server CA, and its key and
+// certificate issued by Go server, or registers the agent with its token
+// when config.RegistrationMode is RegistrationModeToken. While the registration is pending
+// approval, it polls Go server with backoff, and gives up with
+// ErrRegistrationTimeout after config.RegistrationMaxWait.
 func Register() error {
 	if err := ReadGoServerCACert(); err != nil {
 		return err
 	}
-	if err := readAgentKeyAndCerts(registerData()); err != nil {
-		return err
+	interval := RegistrationPollInterval
+	for {
+		var err error
+		if isTokenRegistration() {
+			err = registerWithToken(registerData())
+		} else {
+			err = readAgentKeyAndCerts(registerData())
+		}
+		if err != errPendingApproval {
+			if err == nil {
+				pendingSince = time.Time{}
+				setRegistrationState("registered")
+			}
+			return err
+		}
+		if pendingSince.IsZero() {
+			pendingSince = time.Now()
+			LogInfo("waiting for Go server to approve agent registration, uuid: %v", AgentId)
+		}
+		setRegistrationState("pending approval")
+		wait := interval
+		if config.RegistrationMaxWait > 0 {
+			left := config.RegistrationMaxWait - time.Since(pendingSince)
+			if left <= 0 {
+				logger.Error.Printf("agent registration is not approved in %v", config.RegistrationMaxWait)
+				pendingSince = time.Time{}
+				return ErrRegistrationTimeout
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		LogDebug("registration is pending approval, check again in %v", wait)
+		time.Sleep(wait)
+		interval *= 2
+		if interval > RegistrationMaxPollInterval {
+			interval = RegistrationMaxPollInterval
+		}
+	}
+}
+
+func setRegistrationState(state string) {
+	if GetState("registration") != state {
+		SetState("registration", state)
+	}
+}
+
+// CheckKeyPermissions refuses the agent private key and token being
+// accessible by other users. File permissions are not checked on Windows.
+func CheckKeyPermissions() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	files := []string{config.AgentPrivateKeyFile, config.AgentTokenFile}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if perm := info.Mode().Perm(); perm&0007 != 0 {
+			return Err("%v is accessible by other users (%v), remove their permissions by chmod o-rwx", f, perm)
+		}
 	}
 	return nil
 }
 
 func CleanRegistration() error {
-	files := []string{config.GoServerCAFile,
-		config.AgentPrivateKeyFile,
-		config.AgentCertFile}
+	if err := removeFiles(config.GoServerCAFile); err != nil {
+		return err
+	}
+	return cleanAgentCredentials()
+}
+
+// cleanAgentCredentials removes the agent key, certificate and token, but
+// keeps Go server CA, so that the agent registers again with the server
+// it trusts.
+func cleanAgentCredentials() error {
+	return removeFiles(config.AgentPrivateKeyFile,
+		config.AgentCertFile,
+		config.AgentTokenFile)
+}
+
+func removeFiles(files ...string) error {
 	for _, f := range files {
 		_, err := os.Stat(f)
 		if err == nil {
@@ -175,6 +434,9 @@ func readAgentKeyAndCerts(params map[string]string) error {
 	}
 
 	defer resp.Body.Close()
+	if err := registrationError(resp); err != nil {
+		return err
+	}
 	var registration protocol.Registration
 
 	dec := json.NewDecoder(resp.Body)
@@ -183,24 +445,65 @@ func readAgentKeyAndCerts(params map[string]string) error {
 		return err
 	}
 	if registration.AgentCertificate == "" {
-		return Err("Register failed, probably need approve agent registration on Server side")
+		return errPendingApproval
 	}
 
-	ioutil.WriteFile(config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
-	ioutil.WriteFile(config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
-	return nil
+	if err := WriteFileAtomic(config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600); err != nil {
+		return err
+	}
+	return WriteFileAtomic(config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
 }
 
-func extractServerDN(certFileName string) (string, error) {
-	pemBlock, err := ioutil.ReadFile(certFileName)
+// registerWithToken registers the agent with the token issued by Go
+// server, there is no key or certificate to fetch.
+func registerWithToken(params map[string]string) error {
+	header, err := agentTokenHeader()
 	if err != nil {
-		return "", err
+		return err
+	}
+	form := url.Values{}
+	for k, v := range params {
+		form.Add(k, v)
 	}
 
-	der, _ := pem.Decode(pemBlock)
-	cert, err := x509.ParseCertificate(der.Bytes)
+	client, err := GoServerRemoteClient(false)
+	if err != nil {
+		return err
+	}
+	url, err := config.RegistrationURL()
+	if err != nil {
+		return err
+	}
+	LogInfo("register agent with token: %v", url)
+	req, err := http.NewRequest("POST", url.String(), strings.NewReader(form.Encode()))
 	if err != nil {
-		return "", err
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
-	return cert.Subject.CommonName, nil
+	defer resp.Body.Close()
+	return registrationError(resp)
+}
+
+func registrationError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return errPendingApproval
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return Err("Register is rejected by Go server, check auto register key: %v %v", resp.Status, readBody(resp))
+	case resp.StatusCode >= 500:
+		return Err("Go server failed to register agent: %v %v", resp.Status, readBody(resp))
+	case resp.StatusCode != http.StatusOK:
+		return Err("Register failed: %v %v", resp.Status, readBody(resp))
+	}
+	return nil
+}
+
+func readBody(resp *http.Response) string {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return strings.TrimSpace(string(body))
 }
@@ -0,0 +1,361 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCAFile points config.GoServerCAFile to a file not created yet
+func withCAFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ca")
+	assert.Nil(t, err)
+	config := GetConfig()
+	old := config.GoServerCAFile
+	config.GoServerCAFile = filepath.Join(dir, "go-server-ca.pem")
+	return config.GoServerCAFile, func() {
+		config.GoServerCAFile = old
+		config.GoServerCABundle = ""
+		config.GoServerCAFingerprint = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func serverCert(t *testing.T) *x509.Certificate {
+	data, err := ioutil.ReadFile(goServer.CertPemFile)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	return cert
+}
+
+func TestReadGoServerCACertTrustOnFirstUse(t *testing.T) {
+	caFile, cleanup := withCAFile(t)
+	defer cleanup()
+
+	err := ReadGoServerCACert()
+	assert.Nil(t, err)
+	_, err = os.Stat(caFile)
+	assert.Nil(t, err)
+}
+
+func TestReadGoServerCACertWithFingerprint(t *testing.T) {
+	caFile, cleanup := withCAFile(t)
+	defer cleanup()
+	fingerprint := CertFingerprint(serverCert(t))
+	assert.Equal(t, 95, len(fingerprint))
+
+	GetConfig().GoServerCAFingerprint = "00:11:22"
+	err := ReadGoServerCACert()
+	assert.NotNil(t, err)
+	_, err = os.Stat(caFile)
+	assert.True(t, os.IsNotExist(err))
+
+	GetConfig().GoServerCAFingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	err = ReadGoServerCACert()
+	assert.Nil(t, err)
+	_, err = os.Stat(caFile)
+	assert.Nil(t, err)
+}
+
+func TestReadGoServerCACertWithCABundle(t *testing.T) {
+	caFile, cleanup := withCAFile(t)
+	defer cleanup()
+	dir := filepath.Dir(caFile)
+	otherCA := filepath.Join(dir, "other-ca.pem")
+	err := server.NewCert("localhost").Generate(otherCA, filepath.Join(dir, "other-key.pem"))
+	assert.Nil(t, err)
+
+	GetConfig().GoServerCABundle = otherCA
+	err = ReadGoServerCACert()
+	assert.NotNil(t, err)
+	_, err = os.Stat(caFile)
+	assert.True(t, os.IsNotExist(err))
+
+	GetConfig().GoServerCABundle = goServer.CertPemFile
+	err = ReadGoServerCACert()
+	assert.Nil(t, err)
+	_, err = os.Stat(caFile)
+	assert.Nil(t, err)
+}
+
+func TestReadGoServerCACertShouldVerifySavedCACert(t *testing.T) {
+	caFile, cleanup := withCAFile(t)
+	defer cleanup()
+	dir := filepath.Dir(caFile)
+	err := server.NewCert("localhost").Generate(caFile, filepath.Join(dir, "other-key.pem"))
+	assert.Nil(t, err)
+
+	GetConfig().GoServerCAFingerprint = "00:11:22"
+	err = ReadGoServerCACert()
+	assert.NotNil(t, err)
+	_, err = os.Stat(caFile)
+	assert.True(t, os.IsNotExist(err))
+
+	err = server.NewCert("localhost").Generate(caFile, filepath.Join(dir, "other-key.pem"))
+	assert.Nil(t, err)
+	GetConfig().GoServerCAFingerprint = CertFingerprint(serverCert(t))
+	err = ReadGoServerCACert()
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(caFile)
+	assert.Nil(t, err)
+	expected, err := ioutil.ReadFile(goServer.CertPemFile)
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), string(data))
+
+	err = ReadGoServerCACert()
+	assert.Nil(t, err)
+}
+
+// dialTLSServer starts a tls server with a certificate made by cert, and
+// connects to it with GoServerTlsConfig as serverURL
+func dialTLSServer(t *testing.T, cert *server.Cert, serverURL string) error {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = cert.Generate(certFile, keyFile)
+	assert.Nil(t, err)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	config := GetConfig()
+	oldCAFile, oldURL := config.GoServerCAFile, config.ServerUrl
+	defer func() {
+		config.GoServerCAFile, config.ServerUrl = oldCAFile, oldURL
+	}()
+	config.GoServerCAFile = certFile
+	config.ServerUrl, err = url.Parse(serverURL)
+	assert.Nil(t, err)
+	tlsConfig, err := GoServerTlsConfig(false)
+	assert.Nil(t, err)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+port, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func legacyCert(commonName string) *server.Cert {
+	cert := server.NewCert("")
+	cert.CommonName = commonName
+	return cert
+}
+
+func TestGoServerTlsConfigShouldVerifyServerHostname(t *testing.T) {
+	var tests = []struct {
+		cert      *server.Cert
+		serverURL string
+		legacy    bool
+		ok        bool
+	}{
+		{server.NewCert("localhost"), "https://localhost:8154/go", false, true},
+		{server.NewCert("gocd.example.com,localhost"), "https://localhost:8154/go", false, true},
+		{server.NewCert("127.0.0.1"), "https://127.0.0.1:8154/go", false, true},
+		{server.NewCert("127.0.0.1"), "https://localhost:8154/go", false, false},
+		{server.NewCert("gocd.example.com"), "https://localhost:8154/go", false, false},
+		{legacyCert("localhost"), "https://localhost:8154/go", false, false},
+		{legacyCert("gocd"), "https://localhost:8154/go", true, true},
+		{server.NewCert("localhost"), "https://localhost:8154/go", true, true},
+		{server.NewCert("gocd.example.com"), "https://localhost:8154/go", true, false},
+	}
+	defer func() {
+		GetConfig().AllowLegacyServerCert = false
+	}()
+	for _, test := range tests {
+		GetConfig().AllowLegacyServerCert = test.legacy
+		err := dialTLSServer(t, test.cert, test.serverURL)
+		assert.Equal(t, test.ok, err == nil, test.cert.Host, test.serverURL, err)
+	}
+}
+
+func withoutAgentCert(t *testing.T) func() {
+	_, cleanupCA := withCAFile(t)
+	dir, err := ioutil.TempDir("", "agent-cert")
+	assert.Nil(t, err)
+	config := GetConfig()
+	oldCertFile, oldKeyFile := config.AgentCertFile, config.AgentPrivateKeyFile
+	config.AgentCertFile = filepath.Join(dir, "agent-cert.pem")
+	config.AgentPrivateKeyFile = filepath.Join(dir, "agent-private-key.pem")
+	oldInterval := RegistrationPollInterval
+	RegistrationPollInterval = 10 * time.Millisecond
+	return func() {
+		RegistrationPollInterval = oldInterval
+		config.AgentCertFile, config.AgentPrivateKeyFile = oldCertFile, oldKeyFile
+		config.RegistrationMaxWait = 0
+		goServer.SetRegistrationStatus(0)
+		os.RemoveAll(dir)
+		cleanupCA()
+	}
+}
+
+func TestRegisterShouldPollWhilePendingApproval(t *testing.T) {
+	defer withoutAgentCert(t)()
+	goServer.SetRegistrationStatus(http.StatusAccepted)
+	GetConfig().RegistrationMaxWait = 100 * time.Millisecond
+	count := goServer.Registrations()
+
+	err := Register()
+	assert.Equal(t, ErrRegistrationTimeout, err)
+	assert.Equal(t, "pending approval", GetState("registration"))
+	assert.True(t, goServer.Registrations()-count > 1)
+	_, err = os.Stat(GetConfig().AgentCertFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRegisterAfterApproved(t *testing.T) {
+	defer withoutAgentCert(t)()
+	goServer.SetRegistrationStatus(http.StatusAccepted)
+	time.AfterFunc(50*time.Millisecond, func() {
+		goServer.SetRegistrationStatus(0)
+	})
+
+	err := Register()
+	assert.Nil(t, err)
+	assert.Equal(t, "registered", GetState("registration"))
+	_, err = os.Stat(GetConfig().AgentCertFile)
+	assert.Nil(t, err)
+}
+
+func TestRegisterFailedWithHTTPError(t *testing.T) {
+	defer withoutAgentCert(t)()
+
+	goServer.SetRegistrationStatus(http.StatusForbidden)
+	err := Register()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "rejected"), err.Error())
+	assert.True(t, strings.Contains(err.Error(), "403 Forbidden"), err.Error())
+
+	goServer.SetRegistrationStatus(http.StatusInternalServerError)
+	err = Register()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "500 Internal Server Error"), err.Error())
+}
+
+func withTokenRegistration(t *testing.T) func() {
+	cleanup := withoutAgentCert(t)
+	config := GetConfig()
+	oldTokenFile := config.AgentTokenFile
+	config.AgentTokenFile = filepath.Join(filepath.Dir(config.AgentCertFile), "agent-token")
+	config.RegistrationMode = RegistrationModeToken
+	return func() {
+		config.RegistrationMode = RegistrationModeCert
+		config.AgentTokenFile = oldTokenFile
+		cleanup()
+	}
+}
+
+func TestRegisterWithToken(t *testing.T) {
+	defer withTokenRegistration(t)()
+	config := GetConfig()
+
+	err := Register()
+	assert.Nil(t, err)
+	assert.Equal(t, "registered", GetState("registration"))
+	token, err := ioutil.ReadFile(config.AgentTokenFile)
+	assert.Nil(t, err)
+	assert.Equal(t, goServer.AgentToken(AgentId), string(token))
+	_, err = os.Stat(config.AgentCertFile)
+	assert.True(t, os.IsNotExist(err))
+
+	client, err := GoServerRemoteClient(true)
+	assert.Nil(t, err)
+	resp, err := client.Get(goServerUrl + server.StatusPath)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRegisterWithInvalidToken(t *testing.T) {
+	defer withTokenRegistration(t)()
+	err := ioutil.WriteFile(GetConfig().AgentTokenFile, []byte("invalid"), 0600)
+	assert.Nil(t, err)
+
+	err = Register()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "403 Forbidden"), err.Error())
+
+	client, err := GoServerRemoteClient(true)
+	assert.Nil(t, err)
+	resp, err := client.Get(goServerUrl + server.StatusPath)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestCheckKeyPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on Windows")
+	}
+	defer withoutAgentCert(t)()
+	config := GetConfig()
+	assert.Nil(t, CheckKeyPermissions())
+
+	err := ioutil.WriteFile(config.AgentPrivateKeyFile, []byte("key"), 0644)
+	assert.Nil(t, err)
+	err = CheckKeyPermissions()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), config.AgentPrivateKeyFile), err.Error())
+
+	assert.Nil(t, os.Chmod(config.AgentPrivateKeyFile, 0600))
+	assert.Nil(t, CheckKeyPermissions())
+}
+
+func TestRegisterShouldWriteKeyOnlyReadableByOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on Windows")
+	}
+	defer withoutAgentCert(t)()
+	config := GetConfig()
+
+	assert.Nil(t, Register())
+	for _, f := range []string{config.AgentPrivateKeyFile, config.AgentCertFile} {
+		info, err := os.Stat(f)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	info, err := os.Stat(config.ConfigDir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
@@ -59,6 +59,9 @@ func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
 		ElasticPluginId:              config.AgentAutoRegisterElasticPluginId,
 		ElasticAgentId:               config.AgentAutoRegisterElasticAgentId,
 		SupportsBuildCommandProtocol: true,
+		AgentVersion:                 Version,
+		ProtocolVersion:              protocol.ProtocolVersion,
+		Capabilities:                 Capabilities(),
 	}
 	if cookie := GetState("cookie"); cookie != "" {
 		info.Cookie = cookie
@@ -18,6 +18,10 @@ package agent_test
 import (
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -55,3 +59,27 @@ dest/world=md5-world
 	assert.Equal(t, "md5-5.txt", ret["5.txt"])
 	assert.Equal(t, "md5-world", ret["dest/world"])
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write-file-atomic")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "key.pem")
+
+	assert.Nil(t, WriteFileAtomic(file, []byte("hello"), 0600))
+	assert.Nil(t, WriteFileAtomic(file, []byte("world"), 0600))
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(data))
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(file)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	err = WriteFileAtomic(filepath.Join(dir, "not-exist", "key.pem"), []byte("hello"), 0600)
+	assert.NotNil(t, err)
+}
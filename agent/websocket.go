@@ -46,11 +46,23 @@ func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error
 		return nil, err
 	}
 	wsConfig.TlsConfig = tlsConfig
+	if isTokenRegistration() {
+		header, err := agentTokenHeader()
+		if err != nil {
+			return nil, err
+		}
+		wsConfig.Header = header
+	}
 	LogInfo("connect to: %v", wsLoc)
-	ws, err := websocket.DialConfig(wsConfig)
+	conn, err := DialGoServer(tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	acknowledge := make(chan string)
 	send := make(chan *protocol.Message)
 	received := make(chan *protocol.Message)
@@ -112,6 +124,10 @@ func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ac
 	defer close(received)
 	for {
 		msg, err := protocol.ReceiveMessage(ws)
+		if derr, ok := err.(*protocol.DecodeError); ok {
+			logger.Error.Printf("ignore message: %v", derr)
+			continue
+		}
 		if err != nil {
 			logger.Error.Printf("receive message failed: %v", err)
 			return
@@ -21,6 +21,7 @@ set -e
 #                   src/github.com/gocd-contrib/gocd-golang-agent
 export GOPATH=`pwd`/../../../../
 go get golang.org/x/net/websocket
+go get golang.org/x/net/http/httpproxy
 go get github.com/satori/go.uuid
 go get github.com/xli/assert
 go get github.com/bmatcuk/doublestar
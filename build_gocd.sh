@@ -38,6 +38,10 @@ echo "------------------------------"
 echo "Get golang.org/x/net/websocket"
 go get -u golang.org/x/net/websocket
 
+echo "-----------------------------------"
+echo "Get golang.org/x/net/http/httpproxy"
+go get -u golang.org/x/net/http/httpproxy
+
 echo "---------------------"
 echo "Get golang.org/x/text"
 go get -u golang.org/x/text
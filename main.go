@@ -30,6 +30,7 @@ var (
 )
 
 func main() {
+	agent.ExecBuildProcess()
 
 	versonPtr := flag.Bool("version", false, "Show GoCD Golang Agent Verson")
 	flag.Parse()
@@ -39,9 +40,13 @@ func main() {
 		os.Exit(0)
 	}
 
+	agent.Version = Version
 	agent.Initialize()
 	for {
 		err := agent.Start()
+		if err == agent.ErrRegistrationTimeout {
+			os.Exit(1)
+		}
 		if err != nil {
 			agent.LogInfo("something wrong: %v", err.Error())
 		}
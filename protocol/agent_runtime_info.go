@@ -16,6 +16,10 @@
 
 package protocol
 
+// ProtocolVersion is the version of the build command protocol the agent
+// speaks, advertised to Go server in ping.
+const ProtocolVersion = "1"
+
 type AgentIdentifier struct {
 	HostName  string `json:"hostName"`
 	IpAddress string `json:"ipAddress"`
@@ -39,4 +43,7 @@ type AgentRuntimeInfo struct {
 	ElasticPluginId              string             `json:"elasticPluginId"`
 	ElasticAgentId               string             `json:"elasticAgentId"`
 	SupportsBuildCommandProtocol bool               `json:"supportsBuildCommandProtocol"`
+	AgentVersion                 string             `json:"agentVersion"`
+	ProtocolVersion              string             `json:"protocolVersion"`
+	Capabilities                 []string           `json:"capabilities"`
 }
@@ -30,4 +30,6 @@ type Build struct {
 	ArtifactUploadBaseUrl  string
 	PropertyBaseUrl        string
 	BuildCommand           *BuildCommand
+	// in seconds, the agent cancels the build when it runs longer
+	Timeout int
 }
@@ -28,6 +28,8 @@ const (
 	RunIfConfigPassed = "passed"
 
 	CommandCompose             = "compose"
+	CommandParallel            = "parallel"
+	CommandRetry               = "retry"
 	CommandCond                = "cond"
 	CommandAnd                 = "and"
 	CommandOr                  = "or"
@@ -83,6 +85,14 @@ func ComposeCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand(CommandCompose).AddCommands(commands...)
 }
 
+func ParallelCommand(commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandParallel).AddCommands(commands...)
+}
+
+func RetryCommand(attempts string, commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandRetry).AddArg("attempts", attempts).AddCommands(commands...)
+}
+
 func CondCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand("cond").AddCommands(commands...)
 }
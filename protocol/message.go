@@ -18,6 +18,7 @@ package protocol
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/satori/go.uuid"
 )
 
@@ -41,10 +42,17 @@ type Message struct {
 	AcknowledgeId  string `json:"ackId"`
 }
 
-func (m *Message) DataBuild() *Build {
+// DataBuild decodes the build in message data, the build returned has
+// fields decoded before the error when there is one.
+func (m *Message) DataBuild() (*Build, error) {
 	var build Build
-	json.Unmarshal([]byte(m.Data), &build)
-	return &build
+	if err := json.Unmarshal([]byte(m.Data), &build); err != nil {
+		return &build, &DecodeError{Action: m.Action, Err: err}
+	}
+	if build.BuildCommand == nil {
+		return &build, &DecodeError{Action: m.Action, Err: errors.New("build command is missing")}
+	}
+	return &build, nil
 }
 
 func (m *Message) DataString() string {
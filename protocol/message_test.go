@@ -0,0 +1,51 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestDataBuild(t *testing.T) {
+	msg := BuildMessage(NewBuild("1", "locator", "locator", "/console", "/artifacts", "/properties",
+		EchoCommand("hello")))
+	build, err := msg.DataBuild()
+	assert.Nil(t, err)
+	assert.Equal(t, "1", build.BuildId)
+	assert.Equal(t, CommandCompose, build.BuildCommand.Name)
+}
+
+func TestDataBuildShouldReturnDecodeError(t *testing.T) {
+	msg := &Message{Action: BuildAction, Data: `{"BuildId":"1","BuildCommand":"echo"}`}
+	build, err := msg.DataBuild()
+	assert.NotNil(t, err)
+	assert.Equal(t, "1", build.BuildId)
+	derr, ok := err.(*DecodeError)
+	assert.True(t, ok)
+	assert.Equal(t, BuildAction, derr.Action)
+
+	msg = &Message{Action: BuildAction, Data: `{"BuildId":"2"}`}
+	build, err = msg.DataBuild()
+	assert.Equal(t, "2", build.BuildId)
+	assert.Equal(t, "failed to decode message[build]: build command is missing", err.Error())
+
+	msg = &Message{Action: BuildAction, Data: `not json`}
+	_, err = msg.DataBuild()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+// PluginRequest is written as one JSON document to the stdin of an
+// external build command plugin.
+type PluginRequest struct {
+	Name             string            `json:"name"`
+	Args             map[string]string `json:"args"`
+	Env              map[string]string `json:"env"`
+	WorkingDirectory string            `json:"workingDirectory"`
+}
+
+// PluginMessage is written by a plugin to its stdout, one JSON document
+// per line. Console is appended to the build console log, Export sets
+// build environment variables, Secure lists the names in Export whose
+// values are masked in the console log, and Error fails the build command.
+type PluginMessage struct {
+	Console string            `json:"console,omitempty"`
+	Export  map[string]string `json:"export,omitempty"`
+	Secure  []string          `json:"secure,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
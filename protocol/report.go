@@ -21,4 +21,5 @@ type Report struct {
 	Result           string            `json:"result"`
 	JobState         string            `json:"jobState"`
 	AgentRuntimeInfo *AgentRuntimeInfo `json:"agentRuntimeInfo"`
+	Reason           string            `json:"reason,omitempty"`
 }
@@ -37,13 +37,41 @@ func messageMarshal(v interface{}) ([]byte, byte, error) {
 	return b.Bytes(), websocket.BinaryFrame, err
 }
 
+// DecodeError is a message received that can't be decoded, the
+// connection is still good for receiving the next message.
+type DecodeError struct {
+	// Action of the message, empty when it is unknown
+	Action string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Action == "" {
+		return "failed to decode message: " + e.Err.Error()
+	}
+	return "failed to decode message[" + e.Action + "]: " + e.Err.Error()
+}
+
 func messageUnmarshal(msg []byte, payloadType byte, v interface{}) (err error) {
-	reader, _ := gzip.NewReader(bytes.NewBuffer(msg))
-	jsonBytes, _ := ioutil.ReadAll(reader)
-	return json.Unmarshal(jsonBytes, v)
+	reader, err := gzip.NewReader(bytes.NewBuffer(msg))
+	if err != nil {
+		return &DecodeError{Err: err}
+	}
+	jsonBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return &DecodeError{Err: err}
+	}
+	if err := json.Unmarshal(jsonBytes, v); err != nil {
+		derr := &DecodeError{Err: err}
+		if m, ok := v.(*Message); ok {
+			derr.Action = m.Action
+		}
+		return derr
+	}
+	return nil
 }
 
-var messageCodec = websocket.Codec{messageMarshal, messageUnmarshal}
+var messageCodec = websocket.Codec{Marshal: messageMarshal, Unmarshal: messageUnmarshal}
 
 func ReceiveMessage(conn *websocket.Conn) (*Message, error) {
 	var msg Message
@@ -29,7 +29,10 @@ import (
 )
 
 type Cert struct {
+	// comma separated DNS names and IP addresses of the subject alternative
+	// names, empty for a legacy certificate identified by CommonName only
 	Host         string
+	CommonName   string
 	ValidFrom    time.Time
 	ValidFor     time.Duration
 	IsCA         bool
@@ -85,6 +88,7 @@ func (c *Cert) Generate(certFile, keyFile string) error {
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{c.Organization},
+			CommonName:   c.CommonName,
 		},
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
@@ -94,7 +98,10 @@ func (c *Cert) Generate(certFile, keyFile string) error {
 		BasicConstraintsValid: true,
 	}
 
-	hosts := strings.Split(c.Host, ",")
+	var hosts []string
+	if c.Host != "" {
+		hosts = strings.Split(c.Host, ",")
+	}
 	for _, h := range hosts {
 		if ip := net.ParseIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
@@ -18,8 +18,37 @@ package server
 
 import (
 	"net/http"
+	"time"
 )
 
+const AgentGUIDHeader = "X-Agent-GUID"
+
+// AgentTokenAuthorized rejects requests from an agent registered by token
+// when the token does not match the one issued to the agent. Requests
+// without the agent GUID header are from agents authorized by their
+// certificates, and are not checked.
+func (s *Server) AgentTokenAuthorized(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		uuid := req.Header.Get(AgentGUIDHeader)
+		if uuid != "" && req.Header.Get("Authorization") != s.AgentToken(uuid) {
+			s.log("Agent %v is not authorized by token", uuid)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func (s *Server) Delayed(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if delay := s.ResponseDelay(); delay > 0 {
+			s.log("delay response to %v for %v", req.URL.Path, delay)
+			time.Sleep(delay)
+		}
+		handler(w, req)
+	}
+}
+
 func (s *Server) LimittedRequestEntitySize(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		limit := s.MaxRequestEntitySize()
@@ -56,6 +56,7 @@ func (agent *RemoteAgent) processMessage(server *Server, msg *protocol.Message)
 			server.add(agent)
 			agent.SetCookie()
 		}
+		server.setAgentRuntimeInfo(info)
 		agentState := info.RuntimeStatus
 		server.notifyAgent(agent.id, agentState)
 	case "reportCurrentStatus":
@@ -17,7 +17,12 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
 	"io"
@@ -28,11 +33,13 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	WebSocketPath    = "/agent-websocket"
 	RegistrationPath = "/agent-register"
+	TokenPath        = "/agent-token"
 	StatusPath       = "/status"
 
 	ConsoleLogPath = "/console"
@@ -47,6 +54,8 @@ type StateListener interface {
 type AgentMessage struct {
 	agentId string
 	Msg     *protocol.Message
+	// raw frame sent instead of Msg when it is set
+	raw []byte
 }
 
 type Server struct {
@@ -57,6 +66,11 @@ type Server struct {
 	Logger               *log.Logger
 	StateListeners       []StateListener
 	maxRequestEntitySize int64
+	registrationStatus   int
+	registrations        int
+	tokenSecret          []byte
+	responseDelay        time.Duration
+	runtimeInfos         map[string]*protocol.AgentRuntimeInfo
 	fieldChangeMu        sync.Mutex
 
 	addAgent    chan *RemoteAgent
@@ -65,6 +79,10 @@ type Server struct {
 }
 
 func New(address, certFile, keyFile, workingDir string, logger *log.Logger) *Server {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
 	return &Server{
 		Address:     address,
 		CertPemFile: certFile,
@@ -74,14 +92,16 @@ func New(address, certFile, keyFile, workingDir string, logger *log.Logger) *Ser
 		addAgent:    make(chan *RemoteAgent),
 		delAgent:    make(chan *RemoteAgent),
 		sendMessage: make(chan *AgentMessage),
+		tokenSecret: secret,
 	}
 
 }
 
 func (s *Server) Start() error {
 	go manageAgents(s)
-	http.Handle(WebSocketPath, websocketHandler(s))
+	http.HandleFunc(WebSocketPath, s.AgentTokenAuthorized(websocketHandler(s).ServeHTTP))
 	s.HandleFunc(RegistrationPath, registorHandler(s))
+	s.HandleFunc(TokenPath, tokenHandler(s))
 	s.HandleFunc(ConsoleLogPath+"/", consoleHandler(s))
 	s.HandleFunc(ArtifactsPath+"/", artifactsHandler(s))
 	s.HandleFunc(StatusPath, statusHandler())
@@ -91,7 +111,7 @@ func (s *Server) Start() error {
 
 func (s *Server) HandleFunc(path string, handler func(http.ResponseWriter, *http.Request)) {
 	http.HandleFunc(path,
-		s.LimittedRequestEntitySize(handler))
+		s.AgentTokenAuthorized(s.Delayed(s.LimittedRequestEntitySize(handler))))
 }
 
 func (s *Server) SendBuild(agentId, buildId string, commands ...*protocol.BuildCommand) {
@@ -117,6 +137,72 @@ func (s *Server) MaxRequestEntitySize() int64 {
 	return s.maxRequestEntitySize
 }
 
+// SetResponseDelay makes every http handler, except the websocket one,
+// wait for delay before handling the request, to simulate a slow server.
+func (s *Server) SetResponseDelay(delay time.Duration) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.responseDelay = delay
+}
+
+func (s *Server) ResponseDelay() time.Duration {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.responseDelay
+}
+
+// AgentRuntimeInfo is the runtime info in the last ping of the agent.
+func (s *Server) AgentRuntimeInfo(uuid string) *protocol.AgentRuntimeInfo {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.runtimeInfos[uuid]
+}
+
+func (s *Server) setAgentRuntimeInfo(info *protocol.AgentRuntimeInfo) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	if s.runtimeInfos == nil {
+		s.runtimeInfos = make(map[string]*protocol.AgentRuntimeInfo)
+	}
+	s.runtimeInfos[info.Identifier.Uuid] = info
+}
+
+// SetRegistrationStatus makes the registration endpoint respond with
+// status, e.g. http.StatusAccepted for an agent pending approval, instead
+// of the agent key and certificate. Zero restores the default.
+func (s *Server) SetRegistrationStatus(status int) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.registrationStatus = status
+}
+
+func (s *Server) RegistrationStatus() int {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.registrationStatus
+}
+
+// Registrations is the number of requests to the registration endpoint.
+func (s *Server) Registrations() int {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.registrations
+}
+
+func (s *Server) countRegistration() {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.registrations++
+}
+
+// AgentToken is the token issued to the agent for token based
+// registration.
+func (s *Server) AgentToken(uuid string) string {
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write([]byte(uuid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func (s *Server) ConsoleLog(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ConsoleLogFile(buildId))
 	return string(bytes), err
@@ -151,6 +237,12 @@ func (s *Server) Send(agentId string, msg *protocol.Message) {
 	s.sendMessage <- &AgentMessage{agentId: agentId, Msg: msg}
 }
 
+// SendRaw sends data to the agent as a binary frame as it is, for
+// testing how the agent handles malformed messages.
+func (s *Server) SendRaw(agentId string, data []byte) {
+	s.sendMessage <- &AgentMessage{agentId: agentId, raw: data}
+}
+
 func (s *Server) log(format string, v ...interface{}) {
 	s.Logger.Printf(format, v...)
 }
@@ -211,10 +303,12 @@ func manageAgents(s *Server) {
 			delete(agents, agent.id)
 		case am := <-s.sendMessage:
 			agent := agents[am.agentId]
-			if agent != nil {
-				agent.Send(am.Msg)
+			if agent == nil {
+				s.log("could not find agent by id %v for sending message", am.agentId)
+			} else if am.raw != nil {
+				websocket.Message.Send(agent.conn, am.raw)
 			} else {
-				s.log("could not find agent by id %v for sending message: %v", am.agentId, am.Msg.Action)
+				agent.Send(am.Msg)
 			}
 		}
 	}
@@ -234,6 +328,23 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 		var err error
 		var reg *protocol.Registration
 
+		s.countRegistration()
+		if status := s.RegistrationStatus(); status != 0 {
+			w.WriteHeader(status)
+			if status == http.StatusAccepted {
+				w.Write([]byte("{}"))
+			} else {
+				w.Write([]byte(http.StatusText(status)))
+			}
+			return
+		}
+
+		if req.Header.Get(AgentGUIDHeader) != "" {
+			// agent is authorized by token, there is no certificate
+			// to issue
+			return
+		}
+
 		agentPrivateKey, err = ioutil.ReadFile(s.KeyPemFile)
 		if err != nil {
 			s.responseInternalError(err, w)
@@ -258,6 +369,21 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+func tokenHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		uuid := req.URL.Query().Get("uuid")
+		if uuid == "" {
+			s.responseBadRequest(errors.New("uuid is missing"), w)
+			return
+		}
+		w.Write([]byte(s.AgentToken(uuid)))
+	}
+}
+
 func websocketHandler(s *Server) websocket.Handler {
 	return websocket.Handler(func(ws *websocket.Conn) {
 		agent := &RemoteAgent{conn: ws}
@@ -0,0 +1,270 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	AnsiKeep      = "keep"
+	AnsiStrip     = "strip"
+	AnsiNormalize = "normalize"
+
+	esc = 0x1b
+	bel = 0x07
+)
+
+var ansiReset = []byte("\x1b[0m")
+
+// AnsiWriter filters ANSI escape sequences out of the output.
+//
+// AnsiStrip drops every escape sequence. AnsiNormalize keeps color (SGR)
+// sequences only, and resets colors at the end of every line and restores
+// them on the next one, so nothing written in front of a line, e.g. a
+// timestamp, gets colored. AnsiKeep passes everything through.
+type AnsiWriter struct {
+	io.Writer
+	Mode string
+
+	// incomplete escape sequence at the end of the last write
+	pending []byte
+	// colors in effect
+	sgr     sgrState
+	restore bool
+}
+
+func NewAnsiWriter(writer io.Writer, mode string) *AnsiWriter {
+	return &AnsiWriter{Writer: writer, Mode: mode}
+}
+
+func (w *AnsiWriter) Write(out []byte) (int, error) {
+	if w.Mode != AnsiStrip && w.Mode != AnsiNormalize {
+		return w.Writer.Write(out)
+	}
+	data := out
+	if len(w.pending) > 0 {
+		data = append(w.pending, out...)
+		w.pending = nil
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(data); {
+		c := data[i]
+		if c != esc {
+			if w.restore && c != '\n' {
+				buf.Write(w.sgr.sequence())
+				w.restore = false
+			}
+			if c == '\n' && !w.sgr.isEmpty() && !w.restore {
+				buf.Write(ansiReset)
+				w.restore = true
+			}
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+		n, sgr := escapeSequenceLength(data[i:])
+		if n == 0 {
+			w.pending = append([]byte{}, data[i:]...)
+			break
+		}
+		if sgr && w.Mode == AnsiNormalize {
+			w.color(&buf, data[i:i+n])
+		}
+		i += n
+	}
+
+	_, err := w.Writer.Write(buf.Bytes())
+	return len(out), err
+}
+
+// Close writes out the incomplete escape sequence at the end of the
+// output as text without its escape character, so a sequence that never
+// ends doesn't swallow the output after it, and resets colors still in
+// effect. It does not close the underlying writer.
+func (w *AnsiWriter) Close() error {
+	var err error
+	for len(w.pending) > 0 && err == nil {
+		pending := w.pending
+		w.pending = nil
+		_, err = w.Write(pending[1:])
+	}
+	if err == nil && w.Mode == AnsiNormalize && !w.sgr.isEmpty() && !w.restore {
+		_, err = w.Writer.Write(ansiReset)
+	}
+	w.sgr = sgrState{}
+	w.restore = false
+	return err
+}
+
+func (w *AnsiWriter) color(buf *bytes.Buffer, seq []byte) {
+	wasEmpty := w.sgr.isEmpty()
+	w.sgr.apply(seq)
+	switch {
+	case w.sgr.isEmpty():
+		if !wasEmpty && !w.restore {
+			buf.Write(ansiReset)
+		}
+		w.restore = false
+	case !w.restore:
+		buf.Write(seq)
+	}
+}
+
+// SGR attributes tracked in AnsiNormalize mode, each one is turned on by
+// its own parameters and off independently of the others.
+const (
+	sgrIntensity = iota
+	sgrItalic
+	sgrUnderline
+	sgrBlink
+	sgrInverse
+	sgrConceal
+	sgrStrike
+	sgrForeground
+	sgrBackground
+	sgrAttributes
+)
+
+// sgrState has the parameters in effect for every SGR attribute, empty
+// for an attribute that is off. Unknown parameters are not tracked.
+type sgrState [sgrAttributes]string
+
+func (st *sgrState) isEmpty() bool {
+	return *st == sgrState{}
+}
+
+// sequence returns the SGR sequence turning the state on after a reset.
+func (st *sgrState) sequence() []byte {
+	var params []string
+	for _, p := range st {
+		if p != "" {
+			params = append(params, p)
+		}
+	}
+	return []byte("\x1b[" + strings.Join(params, ";") + "m")
+}
+
+// apply changes the state by the parameters of SGR sequence seq.
+func (st *sgrState) apply(seq []byte) {
+	params := strings.Split(string(seq[2:len(seq)-1]), ";")
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		code, err := strconv.Atoi(strings.SplitN(p, ":", 2)[0])
+		if p == "" {
+			code, err = 0, nil
+		}
+		if err != nil {
+			continue
+		}
+		if p == "38" || p == "48" {
+			// extended color, "5;n" or "2;r;g;b"
+			n := 0
+			if i+1 < len(params) && params[i+1] == "5" {
+				n = 2
+			} else if i+1 < len(params) && params[i+1] == "2" {
+				n = 4
+			}
+			if i+n >= len(params) {
+				n = len(params) - 1 - i
+			}
+			p = strings.Join(params[i:i+n+1], ";")
+			i += n
+		}
+		switch {
+		case code == 0:
+			*st = sgrState{}
+		case code == 1 || code == 2:
+			st[sgrIntensity] = p
+		case code == 22:
+			st[sgrIntensity] = ""
+		case code == 3:
+			st[sgrItalic] = p
+		case code == 23:
+			st[sgrItalic] = ""
+		case code == 4 || code == 21:
+			st[sgrUnderline] = p
+		case code == 24:
+			st[sgrUnderline] = ""
+		case code == 5 || code == 6:
+			st[sgrBlink] = p
+		case code == 25:
+			st[sgrBlink] = ""
+		case code == 7:
+			st[sgrInverse] = p
+		case code == 27:
+			st[sgrInverse] = ""
+		case code == 8:
+			st[sgrConceal] = p
+		case code == 28:
+			st[sgrConceal] = ""
+		case code == 9:
+			st[sgrStrike] = p
+		case code == 29:
+			st[sgrStrike] = ""
+		case code >= 30 && code <= 38, code >= 90 && code <= 97:
+			st[sgrForeground] = p
+		case code == 39:
+			st[sgrForeground] = ""
+		case code >= 40 && code <= 48, code >= 100 && code <= 107:
+			st[sgrBackground] = p
+		case code == 49:
+			st[sgrBackground] = ""
+		}
+	}
+}
+
+// escapeSequenceLength returns the length of the escape sequence at the
+// start of data and whether it is a color (SGR) sequence, or 0 if the
+// sequence is not complete yet.
+func escapeSequenceLength(data []byte) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+	switch data[1] {
+	case '[':
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				return i + 1, data[i] == 'm'
+			}
+			if data[i] < 0x20 {
+				// malformed, drop what we have seen so far
+				return i, false
+			}
+		}
+		return 0, false
+	case ']':
+		for i := 2; i < len(data); i++ {
+			if data[i] == bel {
+				return i + 1, false
+			}
+			if data[i] == esc && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2, false
+			}
+			if data[i] == '\n' {
+				return i, false
+			}
+		}
+		return 0, false
+	default:
+		return 2, false
+	}
+}
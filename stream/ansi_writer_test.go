@@ -0,0 +1,101 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestAnsiWriter(t *testing.T) {
+	var tests = []struct {
+		mode   string
+		inputs []string
+		output string
+	}{
+		{AnsiKeep, []string{"\x1b[31mred\x1b[0m\n"}, "\x1b[31mred\x1b[0m\n"},
+		{AnsiStrip, []string{"\x1b[31mred\x1b[0m\n"}, "red\n"},
+		{AnsiStrip, []string{"\x1b[1;32mbold green\x1b[m plain\n"}, "bold green plain\n"},
+		{AnsiStrip, []string{"\x1b[2K\x1b[1Gprogress 50%\n"}, "progress 50%\n"},
+		{AnsiStrip, []string{"\x1b]0;window title\x07hello\n"}, "hello\n"},
+		{AnsiStrip, []string{"\x1b]0;window title\x1b\\hello\n"}, "hello\n"},
+		{AnsiStrip, []string{"\x1b[3", "1mred\x1b", "[0m\n"}, "red\n"},
+		{AnsiStrip, []string{"\x1b=keypad\n"}, "keypad\n"},
+		{AnsiNormalize, []string{"\x1b[31mred\x1b[0m\n"}, "\x1b[31mred\x1b[0m\n"},
+		{AnsiNormalize, []string{"\x1b[2K\x1b[31mred\x1b[0m\n"}, "\x1b[31mred\x1b[0m\n"},
+		{AnsiNormalize, []string{"\x1b[31mred\nstill red\x1b[0m\n"}, "\x1b[31mred\x1b[0m\n\x1b[31mstill red\x1b[0m\n"},
+		{AnsiNormalize, []string{"\x1b[31mred\n", "\n", "\x1b[1mbold red\n"}, "\x1b[31mred\x1b[0m\n\n\x1b[1;31mbold red\x1b[0m\n"},
+		{AnsiNormalize, []string{"\x1b[31mred\n", "\x1b[0mplain\n"}, "\x1b[31mred\x1b[0m\nplain\n"},
+		{AnsiNormalize, []string{"\x1b[31mred\x1b[39m plain\nplain\n"}, "\x1b[31mred\x1b[0m plain\nplain\n"},
+		{AnsiNormalize, []string{"\x1b[1;31mbold red\x1b[22m red\nred\x1b[0;32m green\n"},
+			"\x1b[1;31mbold red\x1b[22m red\x1b[0m\n\x1b[31mred\x1b[0;32m green\x1b[0m\n"},
+		{AnsiNormalize, []string{"\x1b[38;5;208morange\x1b[4m\nunderlined orange\n"},
+			"\x1b[38;5;208morange\x1b[4m\x1b[0m\n\x1b[4;38;5;208munderlined orange\x1b[0m\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewAnsiWriter(&buf, test.mode)
+		for _, d := range test.inputs {
+			size, err := w.Write([]byte(d))
+			assert.Nil(t, err)
+			assert.Equal(t, len(d), size)
+		}
+		assert.Equal(t, test.output, buf.String())
+	}
+}
+
+func TestAnsiWriterNormalizeShouldNotAccumulateColors(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewAnsiWriter(&buf, AnsiNormalize)
+	for i := 0; i < 1000; i++ {
+		buf.Reset()
+		color := 31 + i%7
+		_, err := w.Write([]byte(fmt.Sprintf("\x1b[%vm\x1b[1mline\x1b[22m\n", color)))
+		assert.Nil(t, err)
+		if i == 0 {
+			assert.Equal(t, "\x1b[31m\x1b[1mline\x1b[22m\x1b[0m\n", buf.String())
+		} else {
+			assert.Equal(t, fmt.Sprintf("\x1b[1;%vmline\x1b[22m\x1b[0m\n", color), buf.String())
+		}
+	}
+}
+
+func TestAnsiWriterCloseShouldFlushIncompleteEscapeSequence(t *testing.T) {
+	var tests = []struct {
+		mode   string
+		input  string
+		output string
+	}{
+		{AnsiStrip, "hello \x1b]0;never ends", "hello ]0;never ends"},
+		{AnsiStrip, "hello\x1b", "hello"},
+		{AnsiStrip, "hello\x1b[3", "hello[3"},
+		{AnsiNormalize, "\x1b[31mred", "\x1b[31mred\x1b[0m"},
+		{AnsiNormalize, "\x1b[31mred\n", "\x1b[31mred\x1b[0m\n"},
+		{AnsiKeep, "hello\x1b[3", "hello\x1b[3"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewAnsiWriter(&buf, test.mode)
+		_, err := w.Write([]byte(test.input))
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+		assert.Equal(t, test.output, buf.String())
+	}
+}
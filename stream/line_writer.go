@@ -0,0 +1,116 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultMaxLineLength = 64 * 1024
+
+// LineWriter assembles the chunks it receives into whole lines before
+// passing them on, so writers downstream never see a line split across
+// two writes. A partial line is passed on once it has waited longer than
+// FlushTimeout or grown past MaxLineLength.
+type LineWriter struct {
+	io.Writer
+	FlushTimeout  time.Duration
+	MaxLineLength int
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	timer *time.Timer
+}
+
+func NewLineWriter(writer io.Writer, flushTimeout time.Duration) *LineWriter {
+	return &LineWriter{
+		Writer:        writer,
+		FlushTimeout:  flushTimeout,
+		MaxLineLength: DefaultMaxLineLength,
+	}
+}
+
+func (w *LineWriter) Write(out []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(out)
+	data := w.buf.Bytes()
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if w.MaxLineLength > 0 && len(data)-end >= w.MaxLineLength {
+		end = len(data)
+	}
+	if end > 0 {
+		if err := w.writeBuffered(end); err != nil {
+			return len(out), err
+		}
+	}
+
+	if w.buf.Len() == 0 {
+		w.stopTimer()
+	} else if w.timer == nil && w.FlushTimeout > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(w.FlushTimeout, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.flushOnTimeout(timer)
+		})
+		w.timer = timer
+	}
+	return len(out), nil
+}
+
+// Flush passes on the buffered partial line, if any.
+func (w *LineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopTimer()
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	return w.writeBuffered(w.buf.Len())
+}
+
+func (w *LineWriter) flushOnTimeout(timer *time.Timer) {
+	// a stale timer may fire after the line it was started for was written
+	if w.timer != timer {
+		return
+	}
+	w.timer = nil
+	if w.buf.Len() > 0 {
+		w.writeBuffered(w.buf.Len())
+	}
+}
+
+func (w *LineWriter) Close() error {
+	return w.Flush()
+}
+
+func (w *LineWriter) writeBuffered(n int) error {
+	_, err := w.Writer.Write(w.buf.Next(n))
+	return err
+}
+
+func (w *LineWriter) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type chunkRecorder struct {
+	mu     sync.Mutex
+	chunks []string
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = append(r.chunks, string(p))
+	return len(p), nil
+}
+
+func (r *chunkRecorder) Chunks() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.chunks...)
+}
+
+func TestLineWriterChunkBoundaries(t *testing.T) {
+	var tests = []struct {
+		inputs []string
+		chunks []string
+	}{
+		{[]string{"hello\n"}, []string{"hello\n"}},
+		{[]string{"hel", "lo\n"}, []string{"hello\n"}},
+		{[]string{"hello\nwor", "ld\n"}, []string{"hello\n", "world\n"}},
+		{[]string{"a\nb\nc"}, []string{"a\nb\n"}},
+		{[]string{"\r", "\n"}, []string{"\r\n"}},
+		{[]string{"hello\r", "\nworld\r\n"}, []string{"hello\r\nworld\r\n"}},
+		{[]string{"", "\n"}, []string{"\n"}},
+	}
+	for _, test := range tests {
+		var r chunkRecorder
+		w := NewLineWriter(&r, 0)
+		for _, d := range test.inputs {
+			size, err := w.Write([]byte(d))
+			assert.Nil(t, err)
+			assert.Equal(t, len(d), size)
+		}
+		assert.Equal(t, test.chunks, r.Chunks())
+	}
+}
+
+func TestLineWriterFlushesPartialLineOnClose(t *testing.T) {
+	var r chunkRecorder
+	w := NewLineWriter(&r, 0)
+	w.Write([]byte("hello\nwor"))
+	w.Write([]byte("ld"))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, []string{"hello\n", "world"}, r.Chunks())
+}
+
+func TestLineWriterFlushesPartialLineOnTimeout(t *testing.T) {
+	var r chunkRecorder
+	w := NewLineWriter(&r, 10*time.Millisecond)
+	w.Write([]byte("waiting for input: "))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"waiting for input: "}, r.Chunks())
+	w.Write([]byte("yes\n"))
+	assert.Equal(t, []string{"waiting for input: ", "yes\n"}, r.Chunks())
+}
+
+func TestLineWriterSplitsVeryLongLines(t *testing.T) {
+	var r chunkRecorder
+	w := NewLineWriter(&r, 0)
+	w.MaxLineLength = 10
+	w.Write([]byte(strings.Repeat("x", 6)))
+	w.Write([]byte(strings.Repeat("x", 6)))
+	w.Write([]byte("\n"))
+	assert.Equal(t, []string{strings.Repeat("x", 12), "\n"}, r.Chunks())
+}
+
+func TestLineWriterKeepsSecretSplitAcrossChunksMasked(t *testing.T) {
+	var buf bytes.Buffer
+	secrets := NewSubstituteWriter(&buf)
+	secrets.Substitutions["password"] = "********"
+	w := NewLineWriter(secrets, 0)
+	w.Write([]byte("the pass"))
+	w.Write([]byte("word is set\n"))
+	assert.Equal(t, "the ******** is set\n", buf.String())
+}
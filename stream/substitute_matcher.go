@@ -0,0 +1,151 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"sort"
+)
+
+// substituteMatcher is an Aho-Corasick automaton over the substitution
+// keys, finding every occurrence of every key in one scan of the input.
+type substituteMatcher struct {
+	keys  []string
+	nodes []matcherNode
+}
+
+type matcherNode struct {
+	next map[byte]int
+	fail int
+	// indexes into keys of every key ending at this node, including
+	// the ones reachable through fail links
+	out []int
+}
+
+type match struct {
+	start, end, key int
+}
+
+func newSubstituteMatcher(keys []string) *substituteMatcher {
+	m := &substituteMatcher{keys: keys, nodes: []matcherNode{{}}}
+	for i, key := range keys {
+		n := 0
+		for j := 0; j < len(key); j++ {
+			next, ok := m.nodes[n].next[key[j]]
+			if !ok {
+				if m.nodes[n].next == nil {
+					m.nodes[n].next = make(map[byte]int)
+				}
+				m.nodes = append(m.nodes, matcherNode{})
+				next = len(m.nodes) - 1
+				m.nodes[n].next[key[j]] = next
+			}
+			n = next
+		}
+		m.nodes[n].out = append(m.nodes[n].out, i)
+	}
+
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for b, child := range m.nodes[n].next {
+			f := m.nodes[n].fail
+			for {
+				if next, ok := m.nodes[f].next[b]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			fail := m.nodes[child].fail
+			m.nodes[child].out = append(m.nodes[child].out, m.nodes[fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+func (m *substituteMatcher) sameKeys(subs map[string]interface{}) bool {
+	size := len(subs)
+	if _, ok := subs[""]; ok {
+		size--
+	}
+	if size != len(m.keys) {
+		return false
+	}
+	for _, k := range m.keys {
+		if _, ok := subs[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns non-overlapping matches ordered by position. Where matches
+// overlap the longest key wins, so a secret containing another secret is
+// never partially revealed.
+func (m *substituteMatcher) find(data []byte) []match {
+	var all []match
+	n := 0
+	for i := 0; i < len(data); i++ {
+		for {
+			if next, ok := m.nodes[n].next[data[i]]; ok {
+				n = next
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = m.nodes[n].fail
+		}
+		for _, k := range m.nodes[n].out {
+			all = append(all, match{start: i + 1 - len(m.keys[k]), end: i + 1, key: k})
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		li, lj := all[i].end-all[i].start, all[j].end-all[j].start
+		if li != lj {
+			return li > lj
+		}
+		return all[i].start < all[j].start
+	})
+	covered := make([]bool, len(data))
+	selected := make([]match, 0, len(all))
+	for _, mt := range all {
+		if covered[mt.start] || covered[mt.end-1] {
+			continue
+		}
+		for i := mt.start; i < mt.end; i++ {
+			covered[i] = true
+		}
+		selected = append(selected, mt)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].start < selected[j].start
+	})
+	return selected
+}
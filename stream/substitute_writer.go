@@ -17,34 +17,78 @@
 package stream
 
 import (
+	"bytes"
 	"io"
-	"strings"
+	"sort"
 )
 
 type SubstituteWriter struct {
 	io.Writer
 	Substitutions map[string]interface{}
+	matcher       *substituteMatcher
 }
 
 func NewSubstituteWriter(writer io.Writer) *SubstituteWriter {
-	return &SubstituteWriter{writer, make(map[string]interface{})}
+	return &SubstituteWriter{Writer: writer, Substitutions: make(map[string]interface{})}
 }
 
 func (w *SubstituteWriter) Filter(writer io.Writer) *SubstituteWriter {
-	return &SubstituteWriter{writer, w.Substitutions}
+	return &SubstituteWriter{Writer: writer, Substitutions: w.Substitutions}
 }
 
-func (w *SubstituteWriter) Write(out []byte) (int, error) {
-	str := string(out)
+// Fork is Filter with a copy of the substitutions, so that substitutions
+// added to one writer later are not seen by the other.
+func (w *SubstituteWriter) Fork(writer io.Writer) *SubstituteWriter {
+	subs := make(map[string]interface{}, len(w.Substitutions))
 	for k, v := range w.Substitutions {
-		vs, ok := v.(string)
-		if !ok {
-			f, _ := v.(func() string)
-			vs = f()
-		}
-		str = strings.Replace(str, k, vs, -1)
+		subs[k] = v
+	}
+	return &SubstituteWriter{Writer: writer, Substitutions: subs}
+}
+
+func (w *SubstituteWriter) Write(out []byte) (int, error) {
+	matches := w.getMatcher().find(out)
+	if len(matches) == 0 {
+		_, err := w.Writer.Write(out)
+		return len(out), err
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		buf.Write(out[last:m.start])
+		buf.WriteString(w.value(w.matcher.keys[m.key]))
+		last = m.end
 	}
+	buf.Write(out[last:])
 
-	_, err := w.Writer.Write([]byte(str))
+	_, err := w.Writer.Write(buf.Bytes())
 	return len(out), err
 }
+
+func (w *SubstituteWriter) value(key string) string {
+	v := w.Substitutions[key]
+	vs, ok := v.(string)
+	if !ok {
+		f, _ := v.(func() string)
+		vs = f()
+	}
+	return vs
+}
+
+// Substitutions is exported and may be changed between writes, so the
+// matcher is rebuilt whenever its key set no longer matches the map.
+func (w *SubstituteWriter) getMatcher() *substituteMatcher {
+	if w.matcher != nil && w.matcher.sameKeys(w.Substitutions) {
+		return w.matcher
+	}
+	keys := make([]string, 0, len(w.Substitutions))
+	for k := range w.Substitutions {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	w.matcher = newSubstituteMatcher(keys)
+	return w.matcher
+}
@@ -58,6 +58,38 @@ func TestSubstituteWriter(t *testing.T) {
 			[]string{"hello ${hello}"},
 			"hello world",
 		},
+		{
+			map[string]interface{}{
+				"secret":       "$$$",
+				"secretsecret": "***",
+			},
+			[]string{"secretsecretsecret"},
+			"***$$$",
+		},
+		{
+			map[string]interface{}{
+				"abc":   "111",
+				"bcdef": "*****",
+			},
+			[]string{"abcdef abc bcdef"},
+			"a***** 111 *****",
+		},
+		{
+			map[string]interface{}{
+				"hello": "world",
+				"world": "!!!!!",
+			},
+			[]string{"hello world"},
+			"world !!!!!",
+		},
+		{
+			map[string]interface{}{
+				"":  "empty",
+				"a": "b",
+			},
+			[]string{"aaa"},
+			"bbb",
+		},
 	}
 	for _, test := range tests {
 		var buf bytes.Buffer
@@ -73,3 +105,25 @@ func TestSubstituteWriter(t *testing.T) {
 		assert.Equal(t, test.output, buf.String())
 	}
 }
+
+func TestSubstituteWriterShouldPickUpNewSubstitutions(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSubstituteWriter(&buf)
+	f := w.Filter(&buf)
+	w.Write([]byte("secret "))
+	w.Substitutions["secret"] = "******"
+	w.Write([]byte("secret "))
+	f.Write([]byte("secret"))
+	assert.Equal(t, "secret ****** ******", buf.String())
+}
+
+func TestSubstituteWriterForkShouldNotShareNewSubstitutions(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSubstituteWriter(&buf)
+	w.Substitutions["foo"] = "***"
+	f := w.Fork(&buf)
+	f.Substitutions["bar"] = "###"
+	w.Write([]byte("foo bar "))
+	f.Write([]byte("foo bar"))
+	assert.Equal(t, "*** bar *** ###", buf.String())
+}
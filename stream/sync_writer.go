@@ -0,0 +1,38 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"io"
+	"sync"
+)
+
+// SyncWriter serializes writes from multiple goroutines to one writer.
+type SyncWriter struct {
+	io.Writer
+	mu sync.Mutex
+}
+
+func NewSyncWriter(writer io.Writer) *SyncWriter {
+	return &SyncWriter{Writer: writer}
+}
+
+func (w *SyncWriter) Write(out []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.Writer.Write(out)
+}